@@ -2,8 +2,20 @@
 
 package main
 
-import "github.com/hellolijj/k8s-device-plugin/pkg/gpu/nvidia"
+import (
+	"flag"
+
+	"github.com/hellolijj/k8s-device-plugin/pkg/gpu/nvidia"
+)
+
+var memoryUnit = flag.String("memory-unit", "", "Share gpus by memory as the aliyun.com/gpu-mem resource, counted in GiB or MiB. Overrides DP_MEMORY_UNIT.")
 
 func main() {
-	nvidia.Run()
+	flag.Parse()
+
+	opts := nvidia.NewOptionsFromEnv()
+	if *memoryUnit != "" {
+		opts.MemoryUnit = *memoryUnit
+	}
+	nvidia.Run(opts)
 }
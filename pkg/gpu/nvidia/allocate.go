@@ -2,20 +2,15 @@ package nvidia
 
 import (
 	"fmt"
-	"time"
+	"strings"
 
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
-)
-
-var (
-	retries = 5
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func buildErrResponse(reqs *pluginapi.AllocateRequest) *pluginapi.AllocateResponse {
@@ -31,8 +26,34 @@ func buildErrResponse(reqs *pluginapi.AllocateRequest) *pluginapi.AllocateRespon
 	return &responses
 }
 
+// buildRestrictedResponse starts the containers without any gpu.
+func buildRestrictedResponse(reqs *pluginapi.AllocateRequest) *pluginapi.AllocateResponse {
+	responses := buildErrResponse(reqs)
+	for _, response := range responses.ContainerResponses {
+		response.Envs[EnvNVGPU] = "none"
+	}
+	return responses
+}
+
+// failAllocation answers the requests kubelet can't get gpus for, according
+// to the failure policy.
+func (m *NvidiaDevicePlugin) failAllocation(reqs *pluginapi.AllocateRequest, err error) (*pluginapi.AllocateResponse, error) {
+	switch m.opts.FailurePolicy {
+	case FailClosedPolicy:
+		return nil, status.Errorf(codes.FailedPrecondition, "gpu allocation failed: %v", err)
+	case RestrictedFailurePolicy:
+		return buildRestrictedResponse(reqs), nil
+	default:
+		return buildErrResponse(reqs), nil
+	}
+}
+
 // Allocate which return list of devices.
 func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	if m.inPlace != nil {
+		return m.inPlace.Allocate(ctx, reqs)
+	}
+
 	devs := m.devs
 	responses := pluginapi.AllocateResponse{}
 
@@ -40,104 +61,244 @@ func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.Alloc
 	var (
 		podReqGPU uint
 		found     bool
-		assumePod *v1.Pod
 	)
-	
+
 	for _, req := range reqs.ContainerRequests {
 		podReqGPU += uint(len(req.DevicesIDs))
 	}
 	log.Infof("RequestPodGPUs: %d", podReqGPU)
 
-	m.Lock()
-	defer m.Unlock()
+	// The pods are looked up and patched without the device lock, which the
+	// health checks need.
+	m.allocations.Lock()
+	defer m.allocations.Unlock()
 	log.Infoln("checking...")
-	pods, err := getCandidatePods()
-	if err != nil {
-		log.Infof("invalid allocation requst: Failed to find candidate pods due to %v", err)
-		return buildErrResponse(reqs), nil
-	}
-
-	if log.V(4) {
-		for _, pod := range pods {
-			log.Infof("Pod %s in ns %s request GPU %d with timestamp %v",
-				pod.Name,
-				pod.Namespace,
-				getGPUCountFromPodResource(pod),
-				getAssumeTimeFromPodAnnotation(pod))
-		}
+	assumePod, reqContainers, err := m.findPod(ctx, reqs, false)
+	if err == nil && assumePod == nil {
+		log.Infof("No pod in the cache requests GPU %d, listing the pending pods.", podReqGPU)
+		m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeNormal, reasonPodCacheMiss,
+			"No pod in the cache requests %d GPUs, listing the pending pods", podReqGPU)
+		assumePod, reqContainers, err = m.findPod(ctx, reqs, true)
 	}
-
-	for _, pod := range pods {
-		if getGPUCountFromPodResource(pod) == podReqGPU {
-			log.Infof("Found Assumed GPU shared Pod %s in ns %s with GPU %d",
-				pod.Name,
-				pod.Namespace,
-				podReqGPU)
-			assumePod = pod
-			found = true
-			break
-		}
+	if err != nil {
+		log.Warningf("invalid allocation requst: %v", err)
+		m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeWarning, reasonGPUAssignFailed,
+			"Failed to allocate %d GPUs: %v", podReqGPU, err)
+		return m.failAllocation(reqs, err)
 	}
+	found = assumePod != nil
 
 	if found {
-		ids := getGPUIDsFromPodAnnotation(assumePod)
-		
-		if len(ids) == 0 {
-			log.Warningf("Failed to get the dev ", assumePod)
+		assignment, err := getContainerGPUIndexes(assumePod, m.gpuTopology, m.registry)
+		if err != nil {
+			log.Warningf("Failed to get the dev ids of pod %s in ns %s: %v", assumePod.Name, assumePod.Namespace, err)
+			m.recorder.Eventf(podRef(assumePod), v1.EventTypeWarning, reasonGPUAssignFailed,
+				"Invalid GPU assignment %q: %v", getGPUIDsFromPodAnnotation(assumePod), err)
+			return m.failAllocation(reqs, fmt.Errorf("pod %s in ns %s: %v", assumePod.Name, assumePod.Namespace, err))
 		}
 
 		// 1. Create container requests
-		for _, req := range reqs.ContainerRequests {
-			response := pluginapi.ContainerAllocateResponse{
-				Envs: map[string]string{
-					EnvNVGPU: ids,
-				},
+		containerNames := []string{}
+		containerUUIDs := map[string][]string{}
+		containerDevices := map[string][]string{}
+		for i, req := range reqs.ContainerRequests {
+			container := reqContainers[i]
+			gpus := assignment[container.Name]
+			if len(gpus) != len(req.DevicesIDs) {
+				m.recorder.Eventf(podRef(assumePod), v1.EventTypeWarning, reasonGPUAssignFailed,
+					"Container %s is assigned GPUs %s but kubelet requests %d GPUs",
+					container.Name,
+					formatGPUIndexes(gpus),
+					len(req.DevicesIDs))
+				return m.failAllocation(reqs, fmt.Errorf("container %s of pod %s in ns %s is assigned gpus %s but requests %d",
+					container.Name,
+					assumePod.Name,
+					assumePod.Namespace,
+					formatGPUIndexes(gpus),
+					len(req.DevicesIDs)))
+			}
+			uuids, err := m.registry.UUIDs(gpus)
+			if err == nil {
+				err = m.checkWholeGPUs(gpus)
+			}
+			if err != nil {
+				m.recorder.Eventf(podRef(assumePod), v1.EventTypeWarning, reasonGPUAssignFailed,
+					"Invalid GPUs for container %s: %v", container.Name, err)
+				return m.failAllocation(reqs, fmt.Errorf("container %s of pod %s in ns %s: %v", container.Name, assumePod.Name, assumePod.Namespace, err))
 			}
+			response := m.containerResponse(gpus, uuids)
 			for _, id := range req.DevicesIDs {
 				if !deviceExists(devs, id) {
-					return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
+					m.recorder.Eventf(podRef(assumePod), v1.EventTypeWarning, reasonUnknownGPU,
+						"Kubelet requested unknown GPU %s for container %s", id, container.Name)
+					m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeWarning, reasonUnknownGPU,
+						"Kubelet requested unknown GPU %s, the node has %d GPUs", id, m.registry.Len())
+					return m.failAllocation(reqs, fmt.Errorf("unknown device: %s", id))
 				}
 			}
 			responses.ContainerResponses = append(responses.ContainerResponses, &response)
+			containerNames = append(containerNames, container.Name)
+			containerUUIDs[container.Name] = uuids
+			containerDevices[container.Name] = req.DevicesIDs
+			log.Infof("Assigned GPUs %s to container %s of pod %s in ns %s",
+				formatGPUIndexes(gpus),
+				container.Name,
+				assumePod.Name,
+				assumePod.Namespace)
 		}
 
 		// 2. Update Pod spec
-		newPod := updatePodAnnotations(assumePod)
-		_, err = clientset.CoreV1().Pods(newPod.Namespace).Update(newPod)
+		updated, err := assignPod(m.kube, assumePod, containerNames)
 		if err != nil {
-			// the object has been modified; please apply your changes to the latest version and try again
-			if err.Error() == OptimisticLockErrorMsg {
-				// retry
-				pod, err := clientset.CoreV1().Pods(assumePod.Namespace).Get(assumePod.Name, metav1.GetOptions{})
-				if err != nil {
-					log.Warningf("Failed due to %v", err)
-					return buildErrResponse(reqs), nil
-				}
-				newPod = updatePodAnnotations(pod)
-				_, err = clientset.CoreV1().Pods(newPod.Namespace).Update(newPod)
-				if err != nil {
-					log.Warningf("Failed due to %v", err)
-					return buildErrResponse(reqs), nil
-				}
-			} else {
-				log.Warningf("Failed due to %v", err)
-				return buildErrResponse(reqs), nil
+			log.Warningf("Failed due to %v", err)
+			m.recorder.Eventf(podRef(assumePod), v1.EventTypeWarning, reasonGPUAssignFailed,
+				"Failed to record the GPU assignment: %v", err)
+			return m.failAllocation(reqs, err)
+		}
+		for _, name := range containerNames {
+			gpus := assignment[name]
+			message := fmt.Sprintf("Assigned GPUs %s to container %s", formatGPUIndexes(gpus), name)
+			if link := m.gpuTopology.linkDescription(gpus); link != "" {
+				message += " via " + link
 			}
+			m.recorder.Event(podRef(updated), v1.EventTypeNormal, reasonGPUAssigned, message)
 		}
+		m.Lock()
+		for _, name := range containerNames {
+			if err := m.ledger.record(updated, name, resourceName, containerDevices[name], containerUUIDs[name]); err != nil {
+				log.Warningf("Failed to record the gpus of container %s of pod %s in ns %s: %v",
+					name,
+					updated.Name,
+					updated.Namespace,
+					err)
+			}
+		}
+		m.pods.assume(updated)
+		m.Unlock()
 
 	} else {
 		log.Warningf("invalid allocation requst: request GPU %d can't be satisfied.",
 			podReqGPU)
-		return buildErrResponse(reqs), nil
+		m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeWarning, reasonNoGPUPod,
+			"No pending pod on the node requests %d GPUs, split %v across containers", podReqGPU, containerRequestSizes(reqs))
+		return m.failAllocation(reqs, fmt.Errorf("no pending pod on node %s requests %d gpus", m.kube.NodeName, podReqGPU))
 	}
 
 	return &responses, nil
 }
 
+// containerResponse hands the gpus to a container, by UUID, as CDI devices
+// or as device nodes and driver mounts depending on the options.
+func (m *NvidiaDevicePlugin) containerResponse(gpus []int, uuids []string) pluginapi.ContainerAllocateResponse {
+	response := pluginapi.ContainerAllocateResponse{
+		Envs: map[string]string{
+			EnvNVGPU: strings.Join(uuids, ","),
+		},
+	}
+	switch {
+	case m.opts.CDIAllocation:
+		response.Envs = map[string]string{}
+		response.Annotations = map[string]string{
+			cdiAnnotation: cdiDeviceNames(uuids),
+		}
+	case m.opts.PassDeviceSpecs:
+		var gpuDevs []*GPUDevice
+		for _, gpu := range gpus {
+			d, _ := m.registry.ByIndex(gpu)
+			gpuDevs = append(gpuDevs, d)
+		}
+		response.Devices = m.driver.deviceSpecs(gpuDevs)
+		response.Mounts = m.driver.mounts()
+	}
+	return response
+}
+
+// checkWholeGPUs fails when one of the gpus, which the scheduler extender
+// may have assigned, is split in MIG instances and so can't be handed out
+// whole.
+func (m *NvidiaDevicePlugin) checkWholeGPUs(gpus []int) error {
+	for _, gpu := range gpus {
+		if m.migParents[gpu] {
+			return fmt.Errorf("gpu %d is split in MIG instances", gpu)
+		}
+	}
+	return nil
+}
+
+// containerRequestSizes returns the number of gpus of each container request.
+func containerRequestSizes(reqs *pluginapi.AllocateRequest) []int {
+	sizes := []int{}
+	for _, req := range reqs.ContainerRequests {
+		sizes = append(sizes, len(req.DevicesIDs))
+	}
+	return sizes
+}
+
+// findPod returns the pod the container requests are for and the requesting
+// containers, or nil if no pod matches. That is the oldest pod assumed by the
+// scheduler extender or, in topology mode, the oldest pod without gpus which
+// then gets gpus picked by the plugin. Pods come from the cache unless live
+// is set.
+func (m *NvidiaDevicePlugin) findPod(ctx context.Context, reqs *pluginapi.AllocateRequest, live bool) (*v1.Pod, []v1.Container, error) {
+	pod, containers, err := m.findAssumedPod(ctx, reqs, live)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find candidate pods due to %v", err)
+	}
+	if pod != nil || m.opts.AllocationMode != TopologyAllocationMode {
+		return pod, containers, nil
+	}
+
+	pod, containers, err = getUnassumedPod(ctx, m.pods, m.checkpoint, reqs, live)
+	if err != nil || pod == nil {
+		return nil, nil, err
+	}
+	log.Infof("No assumed pod requests GPU %d, selecting GPUs by topology.", getGPUCountFromPodResource(pod))
+	return m.assumePodByTopology(ctx, pod, containers, reqs)
+}
+
+// findAssumedPod returns the oldest pod assumed by the scheduler extender
+// which the container requests are for, or nil if there is none. Pods come
+// from the cache unless live is set.
+func (m *NvidiaDevicePlugin) findAssumedPod(ctx context.Context, reqs *pluginapi.AllocateRequest, live bool) (*v1.Pod, []v1.Container, error) {
+	pods, err := getCandidatePods(ctx, m.pods, unassumedGPUPod(reqs), live)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if log.V(4) {
+		for _, pod := range pods {
+			log.Infof("Pod %s in ns %s request GPU %d with timestamp %v",
+				pod.Name,
+				pod.Namespace,
+				getGPUCountFromPodResource(pod),
+				getAssumeTimeFromPodAnnotation(pod))
+		}
+	}
+
+	matched := []*v1.Pod{}
+	for _, pod := range pods {
+		if _, ok := matchGPUContainers(pod, reqs); ok {
+			matched = append(matched, pod)
+		}
+	}
+	matched = narrowByCheckpoint(m.checkpoint, matched, reqs)
+	if len(matched) == 0 {
+		return nil, nil, nil
+	}
+
+	pod := matched[0]
+	containers, _ := matchGPUContainers(pod, reqs)
+	log.Infof("Found Assumed GPU shared Pod %s in ns %s with GPU %d",
+		pod.Name,
+		pod.Namespace,
+		getGPUCountFromPodResource(pod))
+	return pod, containers, nil
+}
+
 // pick up the gpushare pod with assigned status is false, and
-func getCandidatePods() ([]*v1.Pod, error) {
+func getCandidatePods(ctx context.Context, cache *podCache, stale func(*v1.Pod) bool, live bool) ([]*v1.Pod, error) {
 	candidatePods := []*v1.Pod{}
-	allPods, err := getPendingPodsInNode()
+	allPods, err := getPendingPodsInNode(ctx, cache, stale, live)
 	if err != nil {
 		return candidatePods, err
 	}
@@ -160,47 +321,45 @@ func getCandidatePods() ([]*v1.Pod, error) {
 	return makePodOrderdByAge(candidatePods), nil
 }
 
-func getPendingPodsInNode() ([]v1.Pod, error) {
+// getPendingPodsInNode returns the pending pods of the node from the cache.
+// When live is set, the cached pods stale reports are fetched again from the
+// API server instead, see podCache.refresh.
+func getPendingPodsInNode(ctx context.Context, cache *podCache, stale func(*v1.Pod) bool, live bool) ([]v1.Pod, error) {
 	pods := []v1.Pod{}
 
 	podIDMap := map[types.UID]bool{}
 
-	selector := fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName, "status.phase": "Pending"})
-	podList, err := clientset.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{
-		FieldSelector: selector.String(),
-		LabelSelector: labels.Everything().String(),
-	})
-
-	// 延迟 5s 统计 pending pod
-	for i := 0; i < retries && err != nil; i++ {
-		podList, err = clientset.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{
-			FieldSelector: selector.String(),
-			LabelSelector: labels.Everything().String(),
-		})
-		time.Sleep(100 * time.Millisecond)
+	var (
+		podList []*v1.Pod
+		err     error
+	)
+	if live {
+		podList, err = cache.refresh(ctx, stale)
+	} else {
+		podList, err = cache.list(ctx, v1.PodPending)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get Pods assigned to node %v", nodeName)
+		return nil, fmt.Errorf("failed to get Pods assigned to node %v: %v", cache.kube.NodeName, err)
 	}
 
-	log.V(5).Infof("all pod list %v", podList.Items)
+	log.V(5).Infof("all pod list %v", podList)
 
-	for _, pod := range podList.Items {
-		if pod.Spec.NodeName != nodeName {
+	for _, pod := range podList {
+		if pod.Spec.NodeName != cache.kube.NodeName {
 			log.Warningf("Pod name %s in ns %s is not assigned to node %s as expected, it's placed on node %s ",
 				pod.Name,
 				pod.Namespace,
-				nodeName,
+				cache.kube.NodeName,
 				pod.Spec.NodeName)
 		} else {
-			log.Infof("list pod %s in ns %s in node %s and status is %s",
+			log.V(4).Infof("list pod %s in ns %s in node %s and status is %s",
 				pod.Name,
 				pod.Namespace,
-				nodeName,
+				cache.kube.NodeName,
 				pod.Status.Phase,
 			)
 			if _, ok := podIDMap[pod.UID]; !ok {
-				pods = append(pods, pod)
+				pods = append(pods, *pod)
 				podIDMap[pod.UID] = true
 			}
 		}
@@ -210,6 +369,16 @@ func getPendingPodsInNode() ([]v1.Pod, error) {
 	return pods, nil
 }
 
+// unassumedGPUPod matches the pods the container requests fit which are not
+// assumed yet, whose cached copy may miss the annotations of the scheduler
+// extender.
+func unassumedGPUPod(reqs *pluginapi.AllocateRequest) func(*v1.Pod) bool {
+	return func(pod *v1.Pod) bool {
+		_, ok := matchGPUContainers(pod, reqs)
+		return ok && !isGPUAssumedPod(pod)
+	}
+}
+
 // determine if the pod is GPU share pod, and is already assumed but not assigned
 func isGPUAssumedPod(pod *v1.Pod) (assumed bool) {
 	log.V(6).Infof("Determine if the pod %v is GPUSharedAssumed pod", pod)
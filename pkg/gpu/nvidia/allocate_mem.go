@@ -0,0 +1,241 @@
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// memAssignAnnotations are the pod annotations owned by the memory plugin.
+var memAssignAnnotations = []string{
+	EnvMemIdx,
+	EnvMemAssignedFlag,
+	EnvMemAssignedContainers,
+	EnvMemAssumeTime,
+}
+
+// Allocate maps the memory units kubelet picked back onto the single gpu
+// of the pod, the one in its ALIYUN_COM_GPU_MEM_IDX annotation or else the
+// one the units belong to, and tells the containers their memory budget.
+func (m *MemoryDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+
+	var podReqUnits uint
+	for _, req := range reqs.ContainerRequests {
+		podReqUnits += uint(len(req.DevicesIDs))
+	}
+	log.Infof("Allocating %d %s of gpu memory", podReqUnits, m.gpu.opts.MemoryUnit)
+
+	m.gpu.allocations.Lock()
+	defer m.gpu.allocations.Unlock()
+
+	pod, containers, err := m.findPod(ctx, reqs, false)
+	if err == nil && pod == nil {
+		log.Infof("No pod in the cache requests %d %s of gpu memory, listing the pending pods.", podReqUnits, m.gpu.opts.MemoryUnit)
+		m.gpu.recorder.Eventf(m.gpu.recorder.nodeRef(), v1.EventTypeNormal, reasonPodCacheMiss,
+			"No pod in the cache requests %d %s of gpu memory, listing the pending pods", podReqUnits, m.gpu.opts.MemoryUnit)
+		pod, containers, err = m.findPod(ctx, reqs, true)
+	}
+	if err != nil {
+		log.Warningf("invalid allocation requst: %v", err)
+		m.gpu.recorder.Eventf(m.gpu.recorder.nodeRef(), v1.EventTypeWarning, reasonGPUAssignFailed,
+			"Failed to allocate %d %s of GPU memory: %v", podReqUnits, m.gpu.opts.MemoryUnit, err)
+		return m.gpu.failAllocation(reqs, err)
+	}
+	if pod == nil {
+		log.Warningf("invalid allocation requst: request %d %s of gpu memory can't be satisfied.", podReqUnits, m.gpu.opts.MemoryUnit)
+		m.gpu.recorder.Eventf(m.gpu.recorder.nodeRef(), v1.EventTypeWarning, reasonNoGPUPod,
+			"No pending pod on the node requests %d %s of GPU memory", podReqUnits, m.gpu.opts.MemoryUnit)
+		return m.gpu.failAllocation(reqs, fmt.Errorf("no pending pod on node %s requests %d %s of gpu memory", m.gpu.kube.NodeName, podReqUnits, m.gpu.opts.MemoryUnit))
+	}
+
+	gpu, err := m.podGPU(ctx, pod, reqs)
+	if err != nil {
+		log.Warningf("Failed to find the gpu of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+		m.gpu.recorder.Eventf(podRef(pod), v1.EventTypeWarning, reasonGPUAssignFailed,
+			"Invalid GPU memory assignment: %v", err)
+		return m.gpu.failAllocation(reqs, fmt.Errorf("pod %s in ns %s: %v", pod.Name, pod.Namespace, err))
+	}
+	dev, _ := m.gpu.registry.ByIndex(gpu)
+	units := m.memoryUnits(dev)
+	if podUnits := getMemoryUnitsFromPod(pod); podUnits > uint(units) {
+		err := fmt.Errorf("pod requests %d %s of gpu memory but gpu %d has %d", podUnits, m.gpu.opts.MemoryUnit, gpu, units)
+		m.gpu.recorder.Eventf(podRef(pod), v1.EventTypeWarning, reasonGPUAssignFailed,
+			"Invalid GPU memory assignment: %v", err)
+		return m.gpu.failAllocation(reqs, fmt.Errorf("pod %s in ns %s: %v", pod.Name, pod.Namespace, err))
+	}
+
+	containerNames := []string{}
+	for i, req := range reqs.ContainerRequests {
+		container := containers[i]
+		response := m.gpu.containerResponse([]int{gpu}, []string{dev.UUID})
+		response.Envs[EnvMemIdx] = strconv.Itoa(gpu)
+		response.Envs[EnvMemPod] = strconv.Itoa(int(getMemoryUnitsFromPod(pod)))
+		response.Envs[EnvMemContainer] = strconv.Itoa(len(req.DevicesIDs))
+		response.Envs[EnvMemDev] = strconv.Itoa(units)
+		response.Envs[EnvMemUnit] = m.gpu.opts.MemoryUnit
+		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		containerNames = append(containerNames, container.Name)
+		log.Infof("Assigned %d %s of gpu %d to container %s of pod %s in ns %s",
+			len(req.DevicesIDs),
+			m.gpu.opts.MemoryUnit,
+			gpu,
+			container.Name,
+			pod.Name,
+			pod.Namespace)
+	}
+
+	updated, err := assignMemoryPod(m.gpu.kube, pod, gpu, containerNames)
+	if err != nil {
+		log.Warningf("Failed due to %v", err)
+		m.gpu.recorder.Eventf(podRef(pod), v1.EventTypeWarning, reasonGPUAssignFailed,
+			"Failed to record the GPU memory assignment: %v", err)
+		return m.gpu.failAllocation(reqs, err)
+	}
+	for i, name := range containerNames {
+		m.gpu.recorder.Eventf(podRef(updated), v1.EventTypeNormal, reasonGPUAssigned,
+			"Assigned %d %s of GPU %d to container %s", len(reqs.ContainerRequests[i].DevicesIDs), m.gpu.opts.MemoryUnit, gpu, name)
+	}
+	m.gpu.Lock()
+	for i, name := range containerNames {
+		if err := m.gpu.ledger.record(updated, name, MemoryResourceName, reqs.ContainerRequests[i].DevicesIDs, []string{dev.UUID}); err != nil {
+			log.Warningf("Failed to record the gpu memory of container %s of pod %s in ns %s: %v",
+				name,
+				updated.Name,
+				updated.Namespace,
+				err)
+		}
+	}
+	m.gpu.pods.assume(updated)
+	m.gpu.Unlock()
+
+	return &responses, nil
+}
+
+// findPod returns the pending pod the container requests are for and the
+// requesting containers, or nil if no pod matches. Pods the scheduler
+// extender put on a gpu go first, then the oldest. Pods come from the cache
+// unless live is set.
+func (m *MemoryDevicePlugin) findPod(ctx context.Context, reqs *pluginapi.AllocateRequest, live bool) (*v1.Pod, []v1.Container, error) {
+	pods, err := getPendingPodsInNode(ctx, m.gpu.pods, func(pod *v1.Pod) bool {
+		_, ok := matchMemoryContainers(pod, reqs)
+		_, assumed := pod.ObjectMeta.Annotations[EnvMemIdx]
+		return ok && !assumed
+	}, live)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find candidate pods due to %v", err)
+	}
+
+	candidates := []*v1.Pod{}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.ObjectMeta.Annotations[EnvMemAssignedFlag] == "true" {
+			continue
+		}
+		if _, ok := matchMemoryContainers(pod, reqs); ok {
+			candidates = append(candidates, pod)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		_, a := candidates[i].ObjectMeta.Annotations[EnvMemIdx]
+		_, b := candidates[j].ObjectMeta.Annotations[EnvMemIdx]
+		if a != b {
+			return a
+		}
+		return candidates[i].CreationTimestamp.Before(&candidates[j].CreationTimestamp)
+	})
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+
+	pod := candidates[0]
+	containers, _ := matchMemoryContainers(pod, reqs)
+	log.Infof("Found pod %s in ns %s with %d %s of gpu memory",
+		pod.Name,
+		pod.Namespace,
+		getMemoryUnitsFromPod(pod),
+		m.gpu.opts.MemoryUnit)
+	return pod, containers, nil
+}
+
+// podGPU returns the gpu of the pod from its annotation or, without one, the
+// gpu every requested memory unit belongs to. Kubelet accounts aliyun.com/gpu
+// apart, so the gpus held whole by other pods are refused.
+func (m *MemoryDevicePlugin) podGPU(ctx context.Context, pod *v1.Pod, reqs *pluginapi.AllocateRequest) (int, error) {
+	gpu, err := m.requestedGPU(pod, reqs)
+	if err != nil {
+		return 0, err
+	}
+	whole, err := getWholeGPUs(ctx, m.gpu.pods, m.gpu.registry, m.gpu.ledger, m.gpu.checkpoint)
+	if err != nil {
+		return 0, err
+	}
+	if whole[gpu] {
+		return 0, fmt.Errorf("gpu %d is allocated whole through %s", gpu, resourceName)
+	}
+	if m.gpu.migParents[gpu] {
+		return 0, fmt.Errorf("gpu %d is split in MIG instances", gpu)
+	}
+	return gpu, nil
+}
+
+func (m *MemoryDevicePlugin) requestedGPU(pod *v1.Pod, reqs *pluginapi.AllocateRequest) (int, error) {
+	if value, ok := pod.ObjectMeta.Annotations[EnvMemIdx]; ok {
+		return m.gpu.registry.resolve(value)
+	}
+
+	uuids := map[string]bool{}
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			uuids[memoryDeviceGPU(id)] = true
+		}
+	}
+	if len(uuids) != 1 {
+		return 0, fmt.Errorf("no gpu annotation and kubelet requests memory of %d gpus", len(uuids))
+	}
+	for uuid := range uuids {
+		if d, ok := m.gpu.registry.ByUUID(uuid); ok {
+			return int(d.Index), nil
+		}
+		return 0, fmt.Errorf("unknown gpu %s", uuid)
+	}
+	return 0, nil
+}
+
+// updateMemoryPodAnnotations returns the annotations of the pod once the
+// containers got memory of the gpu.
+func updateMemoryPodAnnotations(pod *v1.Pod, gpu int, containers []string) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range pod.ObjectMeta.Annotations {
+		annotations[k] = v
+	}
+
+	annotations[EnvMemAssignedContainers] = addContainers(annotations[EnvMemAssignedContainers], containers)
+	annotations[EnvMemIdx] = strconv.Itoa(gpu)
+
+	newPod := pod.DeepCopy()
+	newPod.ObjectMeta.Annotations = annotations
+	if len(getPendingMemoryContainers(newPod)) == 0 {
+		annotations[EnvMemAssignedFlag] = "true"
+	} else {
+		annotations[EnvMemAssignedFlag] = "false"
+	}
+	annotations[EnvMemAssumeTime] = fmt.Sprintf("%d", time.Now().UnixNano())
+	return annotations
+}
+
+// getMemoryUnitsFromPod returns the memory units all containers of the pod
+// ask for.
+func getMemoryUnitsFromPod(pod *v1.Pod) uint {
+	var units uint
+	for _, container := range pod.Spec.Containers {
+		units += getMemoryUnitsFromContainer(&container)
+	}
+	return units
+}
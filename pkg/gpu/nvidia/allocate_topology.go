@@ -0,0 +1,213 @@
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// assumePodByTopology serves pods the scheduler extender did not annotate:
+// the plugin picks the best connected free gpus itself and records them on
+// the pod like the extender would have. The gpus kubelet requests are kept
+// when they are free, kubelet got them from GetPreferredAllocation. It
+// returns the assumed pod and the containers the requests are for.
+func (m *NvidiaDevicePlugin) assumePodByTopology(ctx context.Context, pod *v1.Pod, containers []v1.Container, reqs *pluginapi.AllocateRequest) (*v1.Pod, []v1.Container, error) {
+	used, err := getUsedGPUs(ctx, m.pods, m.registry, m.ledger, m.checkpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find used gpus due to %v", err)
+	}
+
+	free := []int{}
+	isFree := map[int]bool{}
+	m.RLock()
+	for i, d := range m.devs {
+		if !used[i] && !m.migParents[i] && d.Health == pluginapi.Healthy {
+			free = append(free, i)
+			isFree[i] = true
+		}
+	}
+	m.RUnlock()
+
+	requested := map[string][]int{}
+	required := []int{}
+	for i, req := range reqs.ContainerRequests {
+		gpus, err := m.gpuIndexes(req.DevicesIDs)
+		for _, gpu := range gpus {
+			if !isFree[gpu] {
+				err = fmt.Errorf("gpu %d is in use", gpu)
+			}
+		}
+		if err != nil {
+			log.V(4).Infof("Not keeping the gpus kubelet requests for pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+			requested, required = map[string][]int{}, nil
+			break
+		}
+		requested[containers[i].Name] = gpus
+		required = append(required, gpus...)
+	}
+
+	gpus, err := selectGPUsIncluding(m.gpuTopology, free, required, int(getGPUCountFromPodResource(pod)))
+	if err != nil {
+		m.recorder.Eventf(podRef(pod), v1.EventTypeWarning, reasonGPUAssignFailed,
+			"Can't select GPUs by topology: %v", err)
+		return nil, nil, fmt.Errorf("pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+	}
+
+	groups := map[string][]int{"": gpus}
+	gpuContainers := getGPUContainers(pod)
+	if len(gpuContainers) > 1 {
+		groups, err = splitContainerGPUs(m.gpuTopology, gpus, gpuContainers, requested)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	group := formatGPUGroup(groups)
+	log.Infof("Selected GPUs %s for pod %s in ns %s, weakest link %s",
+		group,
+		pod.Name,
+		pod.Namespace,
+		m.gpuTopology.weakestLink(gpus).Abbreviation())
+
+	message := fmt.Sprintf("The scheduler extender assigned no GPUs, selected GPUs %s by topology", group)
+	if link := m.gpuTopology.linkDescription(gpus); link != "" {
+		message += ", connected via " + link
+	}
+	m.recorder.Event(podRef(pod), v1.EventTypeNormal, reasonGPUTopologySelected, message)
+
+	return assumePodAnnotations(pod, group), containers, nil
+}
+
+// splitContainerGPUs hands the gpus of a pod out to its gpu containers. The
+// containers in requested get their requested gpus, the others share the
+// rest by topology.
+func splitContainerGPUs(topology gpuTopology, gpus []int, containers []v1.Container, requested map[string][]int) (map[string][]int, error) {
+	taken := map[int]bool{}
+	for _, reqGPUs := range requested {
+		for _, gpu := range reqGPUs {
+			taken[gpu] = true
+		}
+	}
+	rest := []int{}
+	for _, gpu := range gpus {
+		if !taken[gpu] {
+			rest = append(rest, gpu)
+		}
+	}
+
+	groups := map[string][]int{}
+	others := []v1.Container{}
+	sizes := []int{}
+	for _, container := range containers {
+		if reqGPUs, ok := requested[container.Name]; ok {
+			groups[container.Name] = reqGPUs
+			continue
+		}
+		others = append(others, container)
+		sizes = append(sizes, int(getGPUCountFromContainer(&container)))
+	}
+	split, err := splitGPUs(topology, rest, sizes)
+	if err != nil {
+		return nil, err
+	}
+	for i, container := range others {
+		groups[container.Name] = split[i]
+	}
+	return groups, nil
+}
+
+// getUnassumedPod returns the oldest pending pod on the node which the
+// container requests are for and carries no gpu assignment from the scheduler
+// extender, or nil if there is none.
+func getUnassumedPod(ctx context.Context, cache *podCache, checkpoint *checkpointCache, reqs *pluginapi.AllocateRequest, live bool) (*v1.Pod, []v1.Container, error) {
+	pods, err := getPendingPodsInNode(ctx, cache, unassumedGPUPod(reqs), live)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := []*v1.Pod{}
+	for i := range pods {
+		pod := &pods[i]
+		if _, ok := pod.ObjectMeta.Annotations[EnvResourceIndex]; ok {
+			continue
+		}
+		if _, ok := matchGPUContainers(pod, reqs); !ok {
+			continue
+		}
+		candidates = append(candidates, pod)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].CreationTimestamp.Before(&candidates[j].CreationTimestamp)
+	})
+	candidates = narrowByCheckpoint(checkpoint, candidates, reqs)
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+	containers, _ := matchGPUContainers(candidates[0], reqs)
+	return candidates[0], containers, nil
+}
+
+// getUsedGPUs returns the indexes of the gpus allocated to, according to the
+// ledger, or reserved by the scheduler extender for, according to the
+// annotations, pods which are still alive on the node. Gpus shared by memory
+// count as used.
+func getUsedGPUs(ctx context.Context, cache *podCache, registry *deviceRegistry, ledger *allocationLedger, checkpoint *checkpointCache) (map[int]bool, error) {
+	return getHeldGPUs(ctx, cache, registry, ledger, checkpoint, true)
+}
+
+// getWholeGPUs is getUsedGPUs for the gpus held whole, through
+// aliyun.com/gpu, only.
+func getWholeGPUs(ctx context.Context, cache *podCache, registry *deviceRegistry, ledger *allocationLedger, checkpoint *checkpointCache) (map[int]bool, error) {
+	return getHeldGPUs(ctx, cache, registry, ledger, checkpoint, false)
+}
+
+// getHeldGPUs returns the gpus held whole by the alive pods of the node, and
+// the gpus they share memory of when shared is set.
+func getHeldGPUs(ctx context.Context, cache *podCache, registry *deviceRegistry, ledger *allocationLedger, checkpoint *checkpointCache, shared bool) (map[int]bool, error) {
+	pods, err := cache.list(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[int]bool{}
+	alive := map[types.UID]bool{}
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		alive[pod.UID] = true
+		groups, err := parseGPUGroup(pod.ObjectMeta.Annotations[EnvResourceIndex], registry)
+		if err != nil {
+			log.Warningf("Ignoring gpus of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+			continue
+		}
+		for _, gpus := range groups {
+			for _, gpu := range gpus {
+				used[gpu] = true
+			}
+		}
+		if value, ok := pod.ObjectMeta.Annotations[EnvMemIdx]; ok && shared {
+			gpu, err := registry.resolve(value)
+			if err != nil {
+				log.Warningf("Ignoring the shared gpu of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+				continue
+			}
+			used[gpu] = true
+		}
+	}
+
+	resource := resourceName
+	if shared {
+		resource = ""
+	}
+	for uuid := range ledger.usedGPUs(alive, resource, checkpoint) {
+		if d, ok := registry.ByUUID(uuid); ok {
+			used[int(d.Index)] = true
+		}
+	}
+	return used, nil
+}
@@ -0,0 +1,109 @@
+package nvidia
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+const (
+	envGPUBackend     = "DP_GPU_BACKEND"
+	envFakeGPUFixture = "DP_FAKE_GPU_FIXTURE"
+
+	nvmlBackendName = "nvml"
+	fakeBackendName = "fake"
+)
+
+// GPUDevice describes every identity the driver reports for one GPU.
+type GPUDevice struct {
+	// Index is the enumeration order of the GPU in the driver library.
+	Index uint
+	UUID  string
+	// Minor is the N in the /dev/nvidiaN device node.
+	Minor uint
+	Path  string
+	BusID string
+	Model string
+	// Memory is the total framebuffer memory in MiB.
+	Memory uint64
+	// NUMANode is the NUMA node the GPU is attached to, -1 when unknown.
+	NUMANode int
+}
+
+// MIGDevice is a Multi-Instance GPU partition of a GPU.
+type MIGDevice struct {
+	// Parent is the GPU the instance is carved out of.
+	Parent *GPUDevice
+	// Index is the position of the instance in its parent.
+	Index uint
+	UUID  string
+	// Profile names the size of the instance, e.g. 1g.5gb.
+	Profile string
+}
+
+// GPUStatus holds the health metrics of a GPU. Metrics the GPU does not
+// support are nil.
+type GPUStatus struct {
+	// Temperature is in °C.
+	Temperature *uint
+	// Power is the power draw in W.
+	Power *uint
+	// ECCErrors is the number of uncorrected ECC errors since the driver
+	// was loaded.
+	ECCErrors *uint64
+	Throttle  nvml.ThrottleReason
+}
+
+// XIDEvent is a critical XID error reported by the driver. An empty UUID
+// means the error could not be attributed to a single GPU.
+type XIDEvent struct {
+	UUID string
+	Xid  uint64
+}
+
+// EventSet delivers XID events for the GPUs registered on it.
+type EventSet interface {
+	// RegisterXIDs subscribes to critical XID errors of dev. Devices which
+	// can't be watched return an error ending with "Not Supported".
+	RegisterXIDs(dev *GPUDevice) error
+	// Wait blocks up to timeout for the next event.
+	Wait(timeout time.Duration) (*XIDEvent, error)
+	Close()
+}
+
+// Backend abstracts the driver library the plugin uses to discover and watch GPUs.
+type Backend interface {
+	Init() error
+	Shutdown() error
+	// Devices returns the GPUs ordered by Index.
+	Devices() ([]*GPUDevice, error)
+	P2PLink(dev1, dev2 *GPUDevice) (gpuTopologyType, error)
+	NVLink(dev1, dev2 *GPUDevice) (gpuTopologyType, error)
+	NewEventSet() (EventSet, error)
+	// ComputeProcesses returns the pids of the compute processes running on dev.
+	ComputeProcesses(dev *GPUDevice) ([]uint, error)
+	// MIGDevices returns the MIG instances of dev, none when MIG is disabled.
+	MIGDevices(dev *GPUDevice) ([]*MIGDevice, error)
+	// Status reads the health metrics of dev.
+	Status(dev *GPUDevice) (*GPUStatus, error)
+}
+
+// NewBackendFromEnv returns the backend selected by DP_GPU_BACKEND,
+// NVML being the default.
+func NewBackendFromEnv() (Backend, error) {
+	switch name := strings.ToLower(os.Getenv(envGPUBackend)); name {
+	case "", nvmlBackendName:
+		return NewNvmlBackend(), nil
+	case fakeBackendName:
+		fixture := os.Getenv(envFakeGPUFixture)
+		if fixture == "" {
+			return nil, fmt.Errorf("please set env %s for the %s gpu backend", envFakeGPUFixture, fakeBackendName)
+		}
+		return LoadFakeBackend(fixture)
+	default:
+		return nil, fmt.Errorf("unknown gpu backend %q", name)
+	}
+}
@@ -0,0 +1,368 @@
+package nvidia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/ghodss/yaml"
+)
+
+// FakeFixture describes a GPU node for the fake backend. It is read from
+// YAML or JSON, for example:
+//
+//	gpus:
+//	- uuid: GPU-a1
+//	- uuid: GPU-a2
+//	topology:
+//	- [X, NV2]
+//	- [NV2, X]
+//	events:
+//	- after: 30s
+//	  uuid: GPU-a2
+//	  xid: 79
+type FakeFixture struct {
+	GPUs []FakeGPU `json:"gpus"`
+	// Topology is a symmetric matrix of link abbreviations (NV2, PIX, SYS...)
+	// indexed like GPUs. The diagonal is ignored.
+	Topology [][]string `json:"topology,omitempty"`
+	// Events are XIDs replayed by every event set, relative to its creation.
+	Events []FakeXIDEvent `json:"events,omitempty"`
+}
+
+// FakeGPU is one GPU of a FakeFixture. Minor, path and bus id default to
+// values derived from the GPU position.
+type FakeGPU struct {
+	UUID   string `json:"uuid"`
+	Minor  *uint  `json:"minor,omitempty"`
+	BusID  string `json:"busId,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Memory uint64 `json:"memory,omitempty"`
+	// XIDUnsupported makes event registration fail like on GPUs too old for health checking.
+	XIDUnsupported bool `json:"xidUnsupported,omitempty"`
+	// Processes are the pids of the compute processes running on the GPU.
+	Processes []uint `json:"processes,omitempty"`
+	// NUMANode defaults to -1, an unknown node.
+	NUMANode *int `json:"numaNode,omitempty"`
+	// MIG lays the GPU out in MIG instances, MIG is disabled when empty.
+	MIG []FakeMIG `json:"mig,omitempty"`
+	// Status holds the health metrics of the GPU.
+	Status FakeStatus `json:"status,omitempty"`
+}
+
+// FakeStatus is the health metrics of a FakeGPU. Unset metrics are not
+// supported by the GPU.
+type FakeStatus struct {
+	Temperature *uint   `json:"temperature,omitempty"`
+	Power       *uint   `json:"power,omitempty"`
+	ECCErrors   *uint64 `json:"eccErrors,omitempty"`
+	// Throttle is a clock throttle reason, e.g. "HW Slowdown".
+	Throttle string `json:"throttle,omitempty"`
+}
+
+// FakeMIG is a MIG instance of a FakeGPU. The UUID defaults to one derived
+// from the GPU UUID and the instance position.
+type FakeMIG struct {
+	UUID    string `json:"uuid,omitempty"`
+	Profile string `json:"profile"`
+}
+
+// FakeXIDEvent is a scripted XID error. An empty UUID hits every GPU.
+type FakeXIDEvent struct {
+	After string `json:"after"`
+	UUID  string `json:"uuid,omitempty"`
+	Xid   uint64 `json:"xid"`
+}
+
+type fakeBackend struct {
+	fixture  *FakeFixture
+	devices  []*GPUDevice
+	migs     [][]*MIGDevice
+	topology gpuTopology
+	events   []fakeEvent
+}
+
+type fakeEvent struct {
+	after time.Duration
+	XIDEvent
+}
+
+// LoadFakeBackend builds a fake backend from a YAML or JSON fixture file.
+func LoadFakeBackend(path string) (Backend, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &FakeFixture{}
+	if err := yaml.Unmarshal(data, fixture); err != nil {
+		return nil, fmt.Errorf("invalid gpu fixture %s: %v", path, err)
+	}
+	return NewFakeBackend(fixture)
+}
+
+// NewFakeBackend returns a backend serving the GPUs, topology and XID events of fixture.
+func NewFakeBackend(fixture *FakeFixture) (Backend, error) {
+	n := len(fixture.GPUs)
+	b := &fakeBackend{fixture: fixture}
+
+	uuids := map[string]bool{}
+	migUUIDs := map[string]bool{}
+	for i, gpu := range fixture.GPUs {
+		if gpu.UUID == "" {
+			return nil, fmt.Errorf("gpu %d has no uuid", i)
+		}
+		if uuids[gpu.UUID] {
+			return nil, fmt.Errorf("duplicated gpu uuid %s", gpu.UUID)
+		}
+		uuids[gpu.UUID] = true
+
+		minor := uint(i)
+		if gpu.Minor != nil {
+			minor = *gpu.Minor
+		}
+		busID := gpu.BusID
+		if busID == "" {
+			busID = fmt.Sprintf("00000000:%02X:00.0", i+1)
+		}
+		numaNode := noNUMANode
+		if gpu.NUMANode != nil {
+			numaNode = *gpu.NUMANode
+		}
+		dev := &GPUDevice{
+			Index:    uint(i),
+			UUID:     gpu.UUID,
+			Minor:    minor,
+			Path:     fmt.Sprintf("/dev/nvidia%d", minor),
+			BusID:    busID,
+			Model:    gpu.Model,
+			Memory:   gpu.Memory,
+			NUMANode: numaNode,
+		}
+		b.devices = append(b.devices, dev)
+
+		var migs []*MIGDevice
+		for j, mig := range gpu.MIG {
+			if mig.Profile == "" {
+				return nil, fmt.Errorf("mig instance %d of gpu %s has no profile", j, gpu.UUID)
+			}
+			uuid := mig.UUID
+			if uuid == "" {
+				uuid = fmt.Sprintf("MIG-%s/%d", gpu.UUID, j)
+			}
+			if migUUIDs[uuid] {
+				return nil, fmt.Errorf("duplicated mig uuid %s", uuid)
+			}
+			migUUIDs[uuid] = true
+			migs = append(migs, &MIGDevice{Parent: dev, Index: uint(j), UUID: uuid, Profile: mig.Profile})
+		}
+		b.migs = append(b.migs, migs)
+	}
+
+	b.topology = make(gpuTopology, n)
+	for i := range b.topology {
+		b.topology[i] = make([]gpuTopologyType, n)
+	}
+	if len(fixture.Topology) != 0 && len(fixture.Topology) != n {
+		return nil, fmt.Errorf("topology has %d rows, expected %d", len(fixture.Topology), n)
+	}
+	for i, row := range fixture.Topology {
+		if len(row) != n {
+			return nil, fmt.Errorf("topology row %d has %d columns, expected %d", i, len(row), n)
+		}
+		for j, abbr := range row {
+			if i == j {
+				continue
+			}
+			t, err := parseGpuTopologyType(abbr)
+			if err != nil {
+				return nil, fmt.Errorf("topology[%d][%d]: %v", i, j, err)
+			}
+			b.topology[i][j] = t
+		}
+	}
+
+	for i, e := range fixture.Events {
+		after, err := time.ParseDuration(e.After)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %v", i, err)
+		}
+		if e.UUID != "" && !uuids[e.UUID] {
+			return nil, fmt.Errorf("event %d: unknown gpu %s", i, e.UUID)
+		}
+		b.events = append(b.events, fakeEvent{after: after, XIDEvent: XIDEvent{UUID: e.UUID, Xid: e.Xid}})
+	}
+	sort.SliceStable(b.events, func(i, j int) bool {
+		return b.events[i].after < b.events[j].after
+	})
+
+	return b, nil
+}
+
+// parseGpuTopologyType is the inverse of gpuTopologyType.Abbreviation.
+func parseGpuTopologyType(abbr string) (gpuTopologyType, error) {
+	abbr = strings.ToUpper(strings.TrimSpace(abbr))
+	if abbr == "" || abbr == "X" {
+		return gpuTopologyType(nvml.P2PLinkUnknown), nil
+	}
+	for t := nvml.P2PLinkUnknown; t <= nvml.SixNVLINKLinks; t++ {
+		if gpuTopologyType(t).Abbreviation() == abbr {
+			return gpuTopologyType(t), nil
+		}
+	}
+	return gpuTopologyType(nvml.P2PLinkUnknown), fmt.Errorf("unknown gpu topology %q", abbr)
+}
+
+func (b *fakeBackend) Init() error {
+	return nil
+}
+
+func (b *fakeBackend) Shutdown() error {
+	return nil
+}
+
+func (b *fakeBackend) Devices() ([]*GPUDevice, error) {
+	devs := make([]*GPUDevice, 0, len(b.devices))
+	for _, d := range b.devices {
+		dev := *d
+		devs = append(devs, &dev)
+	}
+	return devs, nil
+}
+
+func (b *fakeBackend) link(dev1, dev2 *GPUDevice) (gpuTopologyType, error) {
+	n := uint(len(b.devices))
+	if dev1.Index >= n || dev2.Index >= n {
+		return gpuTopologyType(nvml.P2PLinkUnknown), fmt.Errorf("fake: no device with index %d or %d", dev1.Index, dev2.Index)
+	}
+	return b.topology[dev1.Index][dev2.Index], nil
+}
+
+func (b *fakeBackend) P2PLink(dev1, dev2 *GPUDevice) (gpuTopologyType, error) {
+	t, err := b.link(dev1, dev2)
+	if err != nil || t.isNVLink() {
+		return gpuTopologyType(nvml.P2PLinkUnknown), err
+	}
+	return t, nil
+}
+
+func (b *fakeBackend) NVLink(dev1, dev2 *GPUDevice) (gpuTopologyType, error) {
+	t, err := b.link(dev1, dev2)
+	if err != nil || !t.isNVLink() {
+		return gpuTopologyType(nvml.P2PLinkUnknown), err
+	}
+	return t, nil
+}
+
+func (b *fakeBackend) ComputeProcesses(dev *GPUDevice) ([]uint, error) {
+	if dev.Index >= uint(len(b.devices)) {
+		return nil, fmt.Errorf("fake: no device with index %d", dev.Index)
+	}
+	return append([]uint{}, b.fixture.GPUs[dev.Index].Processes...), nil
+}
+
+func (b *fakeBackend) Status(dev *GPUDevice) (*GPUStatus, error) {
+	if dev.Index >= uint(len(b.devices)) {
+		return nil, fmt.Errorf("fake: no device with index %d", dev.Index)
+	}
+	st := b.fixture.GPUs[dev.Index].Status
+	throttle, err := parseThrottleReason(st.Throttle)
+	if err != nil {
+		return nil, err
+	}
+	return &GPUStatus{
+		Temperature: st.Temperature,
+		Power:       st.Power,
+		ECCErrors:   st.ECCErrors,
+		Throttle:    throttle,
+	}, nil
+}
+
+func (b *fakeBackend) MIGDevices(dev *GPUDevice) ([]*MIGDevice, error) {
+	if dev.Index >= uint(len(b.devices)) {
+		return nil, fmt.Errorf("fake: no device with index %d", dev.Index)
+	}
+	var migs []*MIGDevice
+	for _, m := range b.migs[dev.Index] {
+		mig := *m
+		mig.Parent = dev
+		migs = append(migs, &mig)
+	}
+	return migs, nil
+}
+
+func (b *fakeBackend) NewEventSet() (EventSet, error) {
+	return &fakeEventSet{
+		backend:    b,
+		start:      time.Now(),
+		registered: map[string]bool{},
+	}, nil
+}
+
+type fakeEventSet struct {
+	sync.Mutex
+	backend    *fakeBackend
+	start      time.Time
+	next       int
+	registered map[string]bool
+}
+
+func (s *fakeEventSet) RegisterXIDs(dev *GPUDevice) error {
+	for i, d := range s.backend.devices {
+		if d.UUID != dev.UUID {
+			continue
+		}
+		if s.backend.fixture.GPUs[i].XIDUnsupported {
+			return fmt.Errorf("fake: registering events for %s: Not Supported", dev.UUID)
+		}
+		s.Lock()
+		s.registered[dev.UUID] = true
+		s.Unlock()
+		return nil
+	}
+	return fmt.Errorf("fake: device not found")
+}
+
+func (s *fakeEventSet) Wait(timeout time.Duration) (*XIDEvent, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		e, due := s.pop()
+		if e != nil {
+			return e, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("fake: timeout")
+		}
+		wake := deadline
+		if !due.IsZero() && due.Before(wake) {
+			wake = due
+		}
+		time.Sleep(time.Until(wake))
+	}
+}
+
+// pop returns the first due event of a registered device, or the time the
+// next scripted event becomes due.
+func (s *fakeEventSet) pop() (*XIDEvent, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for s.next < len(s.backend.events) {
+		e := s.backend.events[s.next]
+		due := s.start.Add(e.after)
+		if due.After(time.Now()) {
+			return nil, due
+		}
+		s.next++
+		if e.UUID == "" || s.registered[e.UUID] {
+			event := e.XIDEvent
+			return &event, time.Time{}
+		}
+	}
+	return nil, time.Time{}
+}
+
+func (s *fakeEventSet) Close() {}
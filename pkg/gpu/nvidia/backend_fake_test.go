@@ -0,0 +1,178 @@
+package nvidia
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+func TestNewFakeBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture FakeFixture
+		err     string
+	}{
+		{
+			name:    "no gpus",
+			fixture: FakeFixture{},
+		},
+		{
+			name: "topology",
+			fixture: FakeFixture{
+				GPUs:     []FakeGPU{{UUID: "GPU-a"}, {UUID: "GPU-b"}},
+				Topology: [][]string{{"X", "NV2"}, {"nv2", "X"}},
+			},
+		},
+		{
+			name:    "missing uuid",
+			fixture: FakeFixture{GPUs: []FakeGPU{{UUID: "GPU-a"}, {}}},
+			err:     "gpu 1 has no uuid",
+		},
+		{
+			name:    "duplicated uuid",
+			fixture: FakeFixture{GPUs: []FakeGPU{{UUID: "GPU-a"}, {UUID: "GPU-a"}}},
+			err:     "duplicated gpu uuid GPU-a",
+		},
+		{
+			name:    "mig without profile",
+			fixture: FakeFixture{GPUs: []FakeGPU{{UUID: "GPU-a", MIG: []FakeMIG{{}}}}},
+			err:     "has no profile",
+		},
+		{
+			name: "duplicated mig uuid",
+			fixture: FakeFixture{GPUs: []FakeGPU{
+				{UUID: "GPU-a", MIG: []FakeMIG{{UUID: "MIG-a", Profile: "1g.5gb"}}},
+				{UUID: "GPU-b", MIG: []FakeMIG{{UUID: "MIG-a", Profile: "1g.5gb"}}},
+			}},
+			err: "duplicated mig uuid MIG-a",
+		},
+		{
+			name: "missing topology row",
+			fixture: FakeFixture{
+				GPUs:     []FakeGPU{{UUID: "GPU-a"}, {UUID: "GPU-b"}},
+				Topology: [][]string{{"X", "NV2"}},
+			},
+			err: "topology has 1 rows, expected 2",
+		},
+		{
+			name: "short topology row",
+			fixture: FakeFixture{
+				GPUs:     []FakeGPU{{UUID: "GPU-a"}, {UUID: "GPU-b"}},
+				Topology: [][]string{{"X", "NV2"}, {"NV2"}},
+			},
+			err: "topology row 1 has 1 columns, expected 2",
+		},
+		{
+			name: "unknown link",
+			fixture: FakeFixture{
+				GPUs:     []FakeGPU{{UUID: "GPU-a"}, {UUID: "GPU-b"}},
+				Topology: [][]string{{"X", "NV9"}, {"NV2", "X"}},
+			},
+			err: `unknown gpu topology "NV9"`,
+		},
+		{
+			name: "invalid event delay",
+			fixture: FakeFixture{
+				GPUs:   []FakeGPU{{UUID: "GPU-a"}},
+				Events: []FakeXIDEvent{{After: "soon", UUID: "GPU-a", Xid: 79}},
+			},
+			err: "event 0",
+		},
+		{
+			name: "event of an unknown gpu",
+			fixture: FakeFixture{
+				GPUs:   []FakeGPU{{UUID: "GPU-a"}},
+				Events: []FakeXIDEvent{{After: "1s", UUID: "GPU-b", Xid: 79}},
+			},
+			err: "event 0: unknown gpu GPU-b",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := NewFakeBackend(&test.fixture)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: expected an error containing %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestFakeBackendDevices(t *testing.T) {
+	minor := uint(7)
+	node := 1
+	b, err := NewFakeBackend(&FakeFixture{
+		GPUs: []FakeGPU{
+			{UUID: "GPU-a", Memory: 16384, MIG: []FakeMIG{{Profile: "1g.5gb"}, {UUID: "MIG-b", Profile: "2g.10gb"}}},
+			{UUID: "GPU-b", Minor: &minor, BusID: "00000000:3B:00.0", NUMANode: &node},
+		},
+		Topology: [][]string{{"X", "PIX"}, {"PIX", "X"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devs, err := b.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dev      GPUDevice
+		expected GPUDevice
+	}{
+		{*devs[0], GPUDevice{Index: 0, UUID: "GPU-a", Minor: 0, Path: "/dev/nvidia0", BusID: "00000000:01:00.0", Memory: 16384, NUMANode: noNUMANode}},
+		{*devs[1], GPUDevice{Index: 1, UUID: "GPU-b", Minor: 7, Path: "/dev/nvidia7", BusID: "00000000:3B:00.0", NUMANode: 1}},
+	}
+	for _, test := range tests {
+		if test.dev != test.expected {
+			t.Errorf("expected device %+v, got %+v", test.expected, test.dev)
+		}
+	}
+
+	p2p, err := b.P2PLink(devs[0], devs[1])
+	if err != nil || p2p.Abbreviation() != "PIX" {
+		t.Errorf("expected a PIX link, got %s (%v)", p2p.Abbreviation(), err)
+	}
+	nvlink, err := b.NVLink(devs[0], devs[1])
+	if err != nil || nvlink != gpuTopologyType(nvml.P2PLinkUnknown) {
+		t.Errorf("expected no nvlink, got %s (%v)", nvlink.Abbreviation(), err)
+	}
+
+	migs, err := b.MIGDevices(devs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migs) != 2 {
+		t.Fatalf("expected 2 mig instances, got %d", len(migs))
+	}
+	if migs[0].UUID != "MIG-GPU-a/0" || migs[1].UUID != "MIG-b" || migs[1].Index != 1 || migs[1].Parent != devs[0] {
+		t.Errorf("unexpected mig instances %+v %+v", *migs[0], *migs[1])
+	}
+}
+
+func TestFakeBackendStatus(t *testing.T) {
+	temperature := uint(90)
+	b, err := NewFakeBackend(&FakeFixture{GPUs: []FakeGPU{
+		{UUID: "GPU-a", Status: FakeStatus{Temperature: &temperature, Throttle: "HW Slowdown"}},
+		{UUID: "GPU-b", Status: FakeStatus{Throttle: "overheating"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs, _ := b.Devices()
+
+	st, err := b.Status(devs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Temperature == nil || *st.Temperature != 90 || st.Power != nil || st.Throttle != nvml.ThrottleReasonHwSlowdown {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if _, err := b.Status(devs[1]); err == nil {
+		t.Errorf("expected an unknown throttle reason to fail")
+	}
+}
@@ -0,0 +1,255 @@
+package nvidia
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// nvmlBackend talks to the NVIDIA driver through NVML.
+type nvmlBackend struct {
+	// Devices runs on the plugin restarts while the health checks use the
+	// handles, so they are guarded.
+	sync.Mutex
+	devices []*nvml.Device
+	// migs are the MIG instances listed by nvidia-smi, by parent UUID.
+	migs map[string][]*MIGDevice
+}
+
+// NewNvmlBackend returns the NVML backed GPU backend.
+func NewNvmlBackend() Backend {
+	return &nvmlBackend{}
+}
+
+func (b *nvmlBackend) Init() error {
+	return nvml.Init()
+}
+
+func (b *nvmlBackend) Shutdown() error {
+	return nvml.Shutdown()
+}
+
+func (b *nvmlBackend) Devices() ([]*GPUDevice, error) {
+	n, err := nvml.GetDeviceCount()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		handles []*nvml.Device
+		devs    []*GPUDevice
+	)
+	for i := uint(0); i < n; i++ {
+		d, err := nvml.NewDevice(i)
+		if err != nil {
+			return nil, err
+		}
+		var minor uint
+		if _, err = fmt.Sscanf(d.Path, "/dev/nvidia%d", &minor); err != nil {
+			return nil, err
+		}
+		dev := &GPUDevice{
+			Index: i,
+			UUID:  d.UUID,
+			Minor: minor,
+			Path:  d.Path,
+			BusID: d.PCI.BusID,
+			// nvml reports node 0 for unknown nodes through CPUAffinity.
+			NUMANode: pciNUMANode(d.PCI.BusID),
+		}
+		if d.Model != nil {
+			dev.Model = *d.Model
+		}
+		if d.Memory != nil {
+			dev.Memory = *d.Memory
+		}
+		handles = append(handles, d)
+		devs = append(devs, dev)
+	}
+	b.Lock()
+	b.devices = handles
+	b.migs = nil
+	b.Unlock()
+
+	return devs, nil
+}
+
+func (b *nvmlBackend) handle(dev *GPUDevice) (*nvml.Device, error) {
+	b.Lock()
+	devices := b.devices
+	b.Unlock()
+
+	if devices == nil {
+		if _, err := b.Devices(); err != nil {
+			return nil, err
+		}
+		b.Lock()
+		devices = b.devices
+		b.Unlock()
+	}
+	if dev.Index >= uint(len(devices)) {
+		return nil, fmt.Errorf("nvml: no device with index %d", dev.Index)
+	}
+	return devices[dev.Index], nil
+}
+
+func (b *nvmlBackend) P2PLink(dev1, dev2 *GPUDevice) (gpuTopologyType, error) {
+	d1, err := b.handle(dev1)
+	if err != nil {
+		return gpuTopologyType(nvml.P2PLinkUnknown), err
+	}
+	d2, err := b.handle(dev2)
+	if err != nil {
+		return gpuTopologyType(nvml.P2PLinkUnknown), err
+	}
+	link, err := nvml.GetP2PLink(d1, d2)
+	return gpuTopologyType(link), err
+}
+
+func (b *nvmlBackend) NVLink(dev1, dev2 *GPUDevice) (gpuTopologyType, error) {
+	d1, err := b.handle(dev1)
+	if err != nil {
+		return gpuTopologyType(nvml.P2PLinkUnknown), err
+	}
+	d2, err := b.handle(dev2)
+	if err != nil {
+		return gpuTopologyType(nvml.P2PLinkUnknown), err
+	}
+	link, err := nvml.GetNVLink(d1, d2)
+	return gpuTopologyType(link), err
+}
+
+func (b *nvmlBackend) ComputeProcesses(dev *GPUDevice) ([]uint, error) {
+	d, err := b.handle(dev)
+	if err != nil {
+		return nil, err
+	}
+	pids, _, err := d.GetComputeRunningProcesses()
+	return pids, err
+}
+
+func (b *nvmlBackend) Status(dev *GPUDevice) (*GPUStatus, error) {
+	d, err := b.handle(dev)
+	if err != nil {
+		return nil, err
+	}
+	st, err := d.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &GPUStatus{
+		Temperature: st.Temperature,
+		Power:       st.Power,
+		Throttle:    st.Throttle,
+	}
+	for _, count := range []*uint64{st.Memory.ECCErrors.L1Cache, st.Memory.ECCErrors.L2Cache, st.Memory.ECCErrors.Device} {
+		if count == nil {
+			continue
+		}
+		if status.ECCErrors == nil {
+			status.ECCErrors = new(uint64)
+		}
+		*status.ECCErrors += *count
+	}
+	return status, nil
+}
+
+// The NVML bindings predate MIG, so the instances are read from nvidia-smi:
+//
+//	GPU 0: A100-SXM4-40GB (UUID: GPU-5c89852c-d268-c3f3-1b07-005d5ae1dc3f)
+//	  MIG 1g.5gb      Device  0: (UUID: MIG-c6d4f1ef-42e4-5de3-91c7-45d71c87eb3f)
+var (
+	smiGPULine = regexp.MustCompile(`^GPU \d+: .*\(UUID: (\S+)\)`)
+	smiMIGLine = regexp.MustCompile(`^\s+MIG (\S+)\s+Device\s+(\d+): \(UUID: (\S+)\)`)
+)
+
+func (b *nvmlBackend) MIGDevices(dev *GPUDevice) ([]*MIGDevice, error) {
+	b.Lock()
+	all := b.migs
+	b.Unlock()
+
+	if all == nil {
+		out, err := exec.Command("nvidia-smi", "-L").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the mig instances: %v", err)
+		}
+		all = parseMIGDevices(out)
+		b.Lock()
+		b.migs = all
+		b.Unlock()
+	}
+
+	var migs []*MIGDevice
+	for _, m := range all[dev.UUID] {
+		mig := *m
+		mig.Parent = dev
+		migs = append(migs, &mig)
+	}
+	return migs, nil
+}
+
+// parseMIGDevices parses the output of nvidia-smi -L into the MIG instances
+// of every gpu, by gpu UUID. Parents are left unset.
+func parseMIGDevices(out []byte) map[string][]*MIGDevice {
+	migs := map[string][]*MIGDevice{}
+	parent := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := smiGPULine.FindStringSubmatch(line); m != nil {
+			parent = m[1]
+			continue
+		}
+		m := smiMIGLine.FindStringSubmatch(line)
+		if m == nil || parent == "" {
+			continue
+		}
+		index, _ := strconv.Atoi(m[2])
+		migs[parent] = append(migs[parent], &MIGDevice{
+			Index:   uint(index),
+			UUID:    m[3],
+			Profile: m[1],
+		})
+	}
+	return migs
+}
+
+func (b *nvmlBackend) NewEventSet() (EventSet, error) {
+	return &nvmlEventSet{set: nvml.NewEventSet()}, nil
+}
+
+type nvmlEventSet struct {
+	set nvml.EventSet
+}
+
+func (s *nvmlEventSet) RegisterXIDs(dev *GPUDevice) error {
+	return nvml.RegisterEventForDevice(s.set, nvml.XidCriticalError, dev.UUID)
+}
+
+func (s *nvmlEventSet) Wait(timeout time.Duration) (*XIDEvent, error) {
+	e, err := nvml.WaitForEvent(s.set, uint(timeout/time.Millisecond))
+	if err != nil && e.Etype != nvml.XidCriticalError {
+		return nil, err
+	}
+	if e.Etype != nvml.XidCriticalError {
+		return nil, nil
+	}
+
+	event := &XIDEvent{Xid: e.Edata}
+	if e.UUID != nil {
+		event.UUID = *e.UUID
+	}
+	return event, nil
+}
+
+func (s *nvmlEventSet) Close() {
+	nvml.DeleteEventSet(s.set)
+}
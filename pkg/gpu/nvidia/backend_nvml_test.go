@@ -0,0 +1,65 @@
+package nvidia
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMIGDevices(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		expected map[string][]MIGDevice
+	}{
+		{
+			name:     "no gpus",
+			out:      "",
+			expected: map[string][]MIGDevice{},
+		},
+		{
+			name: "mig disabled",
+			out: `GPU 0: Tesla V100-SXM2-16GB (UUID: GPU-1b2c)
+GPU 1: Tesla V100-SXM2-16GB (UUID: GPU-3d4e)
+`,
+			expected: map[string][]MIGDevice{},
+		},
+		{
+			name: "mig instances",
+			out: `GPU 0: A100-SXM4-40GB (UUID: GPU-5c89)
+  MIG 1g.5gb      Device  0: (UUID: MIG-c6d4)
+  MIG 1g.5gb      Device  1: (UUID: MIG-7e8f)
+GPU 1: A100-SXM4-40GB (UUID: GPU-9a0b)
+GPU 2: A100-SXM4-40GB (UUID: GPU-1c2d)
+  MIG 3g.20gb     Device  0: (UUID: MIG-3e4f)
+`,
+			expected: map[string][]MIGDevice{
+				"GPU-5c89": {
+					{Index: 0, UUID: "MIG-c6d4", Profile: "1g.5gb"},
+					{Index: 1, UUID: "MIG-7e8f", Profile: "1g.5gb"},
+				},
+				"GPU-1c2d": {
+					{Index: 0, UUID: "MIG-3e4f", Profile: "3g.20gb"},
+				},
+			},
+		},
+		{
+			name: "instances before any gpu",
+			out: `  MIG 1g.5gb      Device  0: (UUID: MIG-c6d4)
+No devices found.
+`,
+			expected: map[string][]MIGDevice{},
+		},
+	}
+
+	for _, test := range tests {
+		migs := map[string][]MIGDevice{}
+		for parent, instances := range parseMIGDevices([]byte(test.out)) {
+			for _, mig := range instances {
+				migs[parent] = append(migs[parent], *mig)
+			}
+		}
+		if !reflect.DeepEqual(migs, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, migs)
+		}
+	}
+}
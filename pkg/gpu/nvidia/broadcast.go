@@ -0,0 +1,77 @@
+package nvidia
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceBroadcaster keeps the authoritative device list of a resource and
+// fans every change out to all the ListAndWatch streams of kubelet.
+type deviceBroadcaster struct {
+	sync.Mutex
+	devices []*pluginapi.Device
+	// subscribers hold at most the latest list each, so publishing never
+	// waits for a slow stream.
+	subscribers map[chan []*pluginapi.Device]bool
+}
+
+func newDeviceBroadcaster() *deviceBroadcaster {
+	return &deviceBroadcaster{
+		subscribers: map[chan []*pluginapi.Device]bool{},
+	}
+}
+
+// publish replaces the device list and hands it to every subscriber, in
+// place of a list it has not taken yet. It never blocks.
+func (b *deviceBroadcaster) publish(devs []*pluginapi.Device) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.devices = devs
+	for updates := range b.subscribers {
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- devs
+	}
+}
+
+// subscribe returns a channel delivering the current device list and every
+// later one, and the func to unsubscribe.
+func (b *deviceBroadcaster) subscribe() (<-chan []*pluginapi.Device, func()) {
+	b.Lock()
+	defer b.Unlock()
+
+	updates := make(chan []*pluginapi.Device, 1)
+	if b.devices != nil {
+		updates <- b.devices
+	}
+	b.subscribers[updates] = true
+	return updates, func() {
+		b.Lock()
+		delete(b.subscribers, updates)
+		b.Unlock()
+	}
+}
+
+// stream sends the device lists to a ListAndWatch stream until stop is
+// closed or kubelet goes away.
+func (b *deviceBroadcaster) stream(s pluginapi.DevicePlugin_ListAndWatchServer, stop <-chan struct{}) error {
+	updates, unsubscribe := b.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-s.Context().Done():
+			return nil
+		case devs := <-updates:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package nvidia
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	cdiVersion = "0.5.0"
+	// cdiKind is the vendor/class of the gpus in the CDI spec.
+	cdiKind = resourceName
+	// cdiAnnotation carries the CDI devices of a container to the runtime.
+	cdiAnnotation = "cdi.k8s.io/gputopology"
+)
+
+// cdiSpec is the subset of the Container Device Interface spec the plugin
+// writes, see https://github.com/container-orchestrated-devices/container-device-interface.
+type cdiSpec struct {
+	Version        string            `json:"cdiVersion"`
+	Kind           string            `json:"kind"`
+	Devices        []cdiDevice       `json:"devices"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits,omitempty"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string         `json:"env,omitempty"`
+	DeviceNodes []*cdiDeviceNode `json:"deviceNodes,omitempty"`
+	Mounts      []*cdiMount      `json:"mounts,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+// newCDISpec describes every gpu of the registry and every MIG instance as a
+// CDI device named by its UUID. The driver files are shared by all the
+// devices.
+func newCDISpec(registry *deviceRegistry, migs []*MIGDevice, driver *driverFiles) *cdiSpec {
+	spec := &cdiSpec{
+		Version: cdiVersion,
+		Kind:    cdiKind,
+		ContainerEdits: cdiContainerEdits{
+			// The devices are injected already, keep the nvidia runtime
+			// hook from adding all the gpus if it is installed.
+			Env: []string{EnvNVGPU + "=void"},
+		},
+	}
+
+	for _, gpu := range registry.Devices() {
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name: gpu.UUID,
+			ContainerEdits: cdiContainerEdits{
+				DeviceNodes: []*cdiDeviceNode{{
+					Path:        gpu.Path,
+					HostPath:    driver.hostPath(gpu.Path),
+					Permissions: "rw",
+				}},
+			},
+		})
+	}
+
+	// nvidia-smi doesn't tell which capabilities grant an instance, so the
+	// instances get them all and CUDA is restricted to the instance.
+	for _, mig := range migs {
+		device := cdiDevice{
+			Name: mig.UUID,
+			ContainerEdits: cdiContainerEdits{
+				Env: []string{envCUDAVisibleDevices + "=" + mig.UUID},
+				DeviceNodes: []*cdiDeviceNode{{
+					Path:        mig.Parent.Path,
+					HostPath:    driver.hostPath(mig.Parent.Path),
+					Permissions: "rw",
+				}},
+			},
+		}
+		for _, dev := range driver.migCapDevices {
+			device.ContainerEdits.DeviceNodes = append(device.ContainerEdits.DeviceNodes, &cdiDeviceNode{
+				Path:        dev,
+				HostPath:    driver.hostPath(dev),
+				Permissions: "r",
+			})
+		}
+		spec.Devices = append(spec.Devices, device)
+	}
+
+	for _, dev := range driver.controlDevices {
+		spec.ContainerEdits.DeviceNodes = append(spec.ContainerEdits.DeviceNodes, &cdiDeviceNode{
+			Path:        dev,
+			HostPath:    driver.hostPath(dev),
+			Permissions: "rw",
+		})
+	}
+	for _, file := range driver.files {
+		spec.ContainerEdits.Mounts = append(spec.ContainerEdits.Mounts, &cdiMount{
+			HostPath:      driver.hostPath(file),
+			ContainerPath: file,
+			Options:       []string{"ro", "nosuid", "nodev", "bind"},
+		})
+	}
+	return spec
+}
+
+// cdiSpecFile is the file holding the spec of the plugin in dir.
+func cdiSpecFile(dir string) string {
+	return filepath.Join(dir, strings.Replace(cdiKind, "/", "-", -1)+".json")
+}
+
+// writeCDISpec replaces the spec file in dir unless it holds the spec
+// already, and reports whether it did. The file is renamed into place so
+// runtimes never read a partial spec.
+func writeCDISpec(dir string, spec *cdiSpec) (bool, error) {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if current, err := ioutil.ReadFile(cdiSpecFile(dir)); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	return true, writeFileAtomic(cdiSpecFile(dir), data, 0644)
+}
+
+// cdiDeviceNames returns the fully qualified CDI names of the gpus, e.g.
+// aliyun.com/gpu=GPU-8d4a....
+func cdiDeviceNames(uuids []string) string {
+	names := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		names = append(names, fmt.Sprintf("%s=%s", cdiKind, uuid))
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,50 @@
+package nvidia
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteCDISpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry := newTestRegistry(t, 2)
+	driver := &driverFiles{
+		hostRoot:       "/",
+		controlDevices: []string{"/dev/nvidiactl"},
+		migCapDevices:  []string{"/dev/nvidia-caps/nvidia-cap1"},
+	}
+	parent, _ := registry.ByIndex(1)
+	migs := []*MIGDevice{{Parent: parent, UUID: "MIG-a", Profile: "1g.5gb"}}
+
+	spec := newCDISpec(registry, migs, driver)
+	names := []string{}
+	for _, d := range spec.Devices {
+		names = append(names, d.Name)
+	}
+	if len(names) != 3 || names[0] != "GPU-0" || names[1] != "GPU-1" || names[2] != "MIG-a" {
+		t.Fatalf("expected the gpus and the mig instance, got %v", names)
+	}
+	if nodes := spec.Devices[2].ContainerEdits.DeviceNodes; len(nodes) != 2 || nodes[0].Path != parent.Path {
+		t.Errorf("expected the mig instance to get its parent and the capabilities, got %v", nodes)
+	}
+
+	for i, expected := range []bool{true, false} {
+		written, err := writeCDISpec(dir, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != expected {
+			t.Errorf("write %d: expected written %v, got %v", i, expected, written)
+		}
+	}
+	written, err := writeCDISpec(dir, newCDISpec(registry, nil, driver))
+	if err != nil || !written {
+		t.Errorf("expected a changed device set to be written, got %v %v", written, err)
+	}
+}
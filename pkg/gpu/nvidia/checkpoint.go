@@ -0,0 +1,209 @@
+package nvidia
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// kubeletCheckpointName is the file the kubelet device manager keeps its
+// allocations in, next to kubelet.sock.
+const kubeletCheckpointName = "kubelet_internal_checkpoint"
+
+// kubeletCheckpoint is the part of the kubelet device manager checkpoint the
+// plugin reads. Kubelet 1.10 wrote the entries at the top level, later
+// versions wrap them in Data.
+type kubeletCheckpoint struct {
+	Data struct {
+		PodDeviceEntries []podDevicesEntry
+	}
+	PodDeviceEntries []podDevicesEntry
+}
+
+type podDevicesEntry struct {
+	PodUID        string
+	ContainerName string
+	ResourceName  string
+	// DeviceIDs is a list of ids, or a map of NUMA node to ids since kubelet 1.20.
+	DeviceIDs json.RawMessage
+}
+
+// checkpointDevices maps pod UID and container name to the devices of the
+// container.
+type checkpointDevices map[types.UID]map[string][]string
+
+// readKubeletCheckpoint returns the devices kubelet has allocated so far, by
+// resource.
+func readKubeletCheckpoint(path string) (map[string]checkpointDevices, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &kubeletCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+
+	entries := append(checkpoint.Data.PodDeviceEntries, checkpoint.PodDeviceEntries...)
+	resources := map[string]checkpointDevices{}
+	for _, entry := range entries {
+		ids, err := parseCheckpointDeviceIDs(entry.DeviceIDs)
+		if err != nil {
+			return nil, err
+		}
+		devices := resources[entry.ResourceName]
+		if devices == nil {
+			devices = checkpointDevices{}
+			resources[entry.ResourceName] = devices
+		}
+		uid := types.UID(entry.PodUID)
+		if devices[uid] == nil {
+			devices[uid] = map[string][]string{}
+		}
+		devices[uid][entry.ContainerName] = append(devices[uid][entry.ContainerName], ids...)
+	}
+	return resources, nil
+}
+
+func parseCheckpointDeviceIDs(raw json.RawMessage) ([]string, error) {
+	var ids []string
+	if err := json.Unmarshal(raw, &ids); err == nil {
+		return ids, nil
+	}
+	byNUMANode := map[string][]string{}
+	if err := json.Unmarshal(raw, &byNUMANode); err != nil {
+		return nil, err
+	}
+	for _, nodeIDs := range byNUMANode {
+		ids = append(ids, nodeIDs...)
+	}
+	return ids, nil
+}
+
+// checkpointCache reads the kubelet checkpoint again only when it changed.
+type checkpointCache struct {
+	path string
+
+	sync.Mutex
+	modTime   time.Time
+	size      int64
+	resources map[string]checkpointDevices
+}
+
+func newCheckpointCache(path string) *checkpointCache {
+	return &checkpointCache{path: path}
+}
+
+// read returns the devices of resource in the checkpoint, from the last read
+// unless the file was modified since.
+func (c *checkpointCache) read(resource string) (checkpointDevices, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	info, err := os.Stat(c.path)
+	if err != nil {
+		c.resources = nil
+		return nil, err
+	}
+	if c.resources == nil || !info.ModTime().Equal(c.modTime) || info.Size() != c.size {
+		resources, err := readKubeletCheckpoint(c.path)
+		if err != nil {
+			c.resources = nil
+			return nil, err
+		}
+		c.modTime, c.size, c.resources = info.ModTime(), info.Size(), resources
+	}
+	if devices, ok := c.resources[resource]; ok {
+		return devices, nil
+	}
+	return checkpointDevices{}, nil
+}
+
+// allocated reports whether kubelet already holds devices for the container.
+func (c checkpointDevices) allocated(uid types.UID, container string) bool {
+	_, ok := c[uid][container]
+	return ok
+}
+
+// owner returns the pod and container kubelet allocated exactly ids to.
+func (c checkpointDevices) owner(ids []string) (types.UID, string, bool) {
+	want := deviceSetKey(ids)
+	for uid, containers := range c {
+		for container, devs := range containers {
+			if deviceSetKey(devs) == want {
+				return uid, container, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func deviceSetKey(ids []string) string {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// narrowByCheckpoint drops the candidates, which all match the requests by
+// gpu count, the requests can't be for. Kubelet only checkpoints a container
+// after its allocation succeeded, so the checkpoint knows nothing of the pod
+// asking for the first time and can't tell apart two new pods asking for the
+// same number of gpus, the caller keeps picking the oldest. It only helps in
+// two cases: kubelet asking again for exactly the gpus it checkpointed, after
+// a restart, picks the pod they are checkpointed for, and candidates whose
+// requesting containers hold gpus already are not the ones asking. The
+// candidates are returned unchanged when the checkpoint can't be read.
+func narrowByCheckpoint(checkpoint *checkpointCache, candidates []*v1.Pod, reqs *pluginapi.AllocateRequest) []*v1.Pod {
+	devices, err := checkpoint.read(resourceName)
+	if err != nil {
+		log.V(4).Infof("Not using the kubelet checkpoint: %v", err)
+		return candidates
+	}
+
+	for _, req := range reqs.ContainerRequests {
+		uid, container, ok := devices.owner(req.DevicesIDs)
+		if !ok {
+			continue
+		}
+		for _, pod := range candidates {
+			if pod.UID == uid {
+				log.Infof("Kubelet checkpoint has devices %v for container %s of pod %s in ns %s",
+					req.DevicesIDs,
+					container,
+					pod.Name,
+					pod.Namespace)
+				return []*v1.Pod{pod}
+			}
+		}
+	}
+
+	narrowed := []*v1.Pod{}
+	for _, pod := range candidates {
+		containers, _ := matchGPUContainers(pod, reqs)
+		allocated := false
+		for _, container := range containers {
+			if devices.allocated(pod.UID, container.Name) {
+				allocated = true
+				break
+			}
+		}
+		if allocated {
+			log.V(4).Infof("Skipping pod %s in ns %s, kubelet checkpointed its containers already", pod.Name, pod.Namespace)
+			continue
+		}
+		narrowed = append(narrowed, pod)
+	}
+	if len(narrowed) > 1 {
+		log.Infof("Kubelet checkpoint leaves %d candidate pods, picking the oldest", len(narrowed))
+	}
+	return narrowed
+}
@@ -0,0 +1,75 @@
+package nvidia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestNarrowByCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, kubeletCheckpointName)
+	checkpoint := newCheckpointCache(path)
+
+	pod := func(uid string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: uid, UID: types.UID(uid)},
+			Spec: v1.PodSpec{Containers: []v1.Container{{
+				Name: "main",
+				Resources: v1.ResourceRequirements{
+					Limits: v1.ResourceList{resourceName: resource.MustParse("1")},
+				},
+			}}},
+		}
+	}
+	candidates := []*v1.Pod{pod("a"), pod("b")}
+	reqs := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-1"}}}}
+	names := func(pods []*v1.Pod) string {
+		s := ""
+		for _, p := range pods {
+			s += p.Name
+		}
+		return s
+	}
+
+	if narrowed := narrowByCheckpoint(checkpoint, candidates, reqs); names(narrowed) != "ab" {
+		t.Errorf("expected the candidates without a checkpoint, got %s", names(narrowed))
+	}
+
+	tests := []struct {
+		checkpoint string
+		expected   string
+	}{
+		// a holds gpus already, b is the one asking.
+		{`{"Data":{"PodDeviceEntries":[{"PodUID":"a","ContainerName":"main","ResourceName":"aliyun.com/gpu","DeviceIDs":["GPU-0"]}]}}`, "b"},
+		// kubelet asks again for the gpus it checkpointed for b.
+		{`{"Data":{"PodDeviceEntries":[{"PodUID":"b","ContainerName":"main","ResourceName":"aliyun.com/gpu","DeviceIDs":{"0":["GPU-1"]}}]}}`, "b"},
+		// Other resources don't count.
+		{`{"Data":{"PodDeviceEntries":[{"PodUID":"a","ContainerName":"main","ResourceName":"aliyun.com/gpu-mem","DeviceIDs":["GPU-0-0"]}]}}`, "ab"},
+	}
+	for i, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.checkpoint), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Tell the versions apart on file systems with a coarse mtime.
+		mtime := time.Now().Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if narrowed := narrowByCheckpoint(checkpoint, candidates, reqs); names(narrowed) != test.expected {
+			t.Errorf("checkpoint %d: expected %s, got %s", i, test.expected, names(narrowed))
+		}
+	}
+}
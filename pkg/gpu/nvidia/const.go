@@ -4,13 +4,26 @@ const (
 	ENV_GPU_TOPOLOGY_PRIFIX = "GPU"
 	ResourceName = "aliyun.com/gpu"
 	
-	OptimisticLockErrorMsg = "the object has been modified; please apply your changes to the latest version and try again"
-	
 	EnvNVGPU              = "NVIDIA_VISIBLE_DEVICES"
-	EnvResourceIndex      = "ALIYUN_COM_GPU_GROUP"       // 在 annotation 标记使用哪些gpuid 格式 1,2,4 or 2
+	EnvResourceIndex      = "ALIYUN_COM_GPU_GROUP"       // 在 annotation 标记使用哪些gpuid 格式 1,2,4 or 2, 多容器 {"c1":"0,1","c2":"2"}
 	EnvAssignedFlag       = "ALIYUN_COM_GPU_ASSIGNED"
+	EnvAssignedContainers = "ALIYUN_COM_GPU_ASSIGNED_CONTAINERS" // 已分配 gpu 的容器 格式 c1,c2
 	EnvResourceAssumeTime = "ALIYUN_COM_GPU_ASSUME_TIME"
 	EnvAnnotationKey      = "GPU_TOPOLOGY"
+	EnvMaintenanceKey     = "GPU_MAINTENANCE" // node annotation 标记维护中的 gpu 格式 0,2 或 uuid
+	EnvHealthHistoryKey   = "GPU_HEALTH_HISTORY" // node annotation 记录 gpu 健康状态的变化, 格式 {"0":[{"time":...,"health":...,"reason":...}]}
 	
 	EnvNodeType           = "NODE_TYPE"
+
+	MemoryResourceName       = "aliyun.com/gpu-mem"
+	EnvMemIdx                = "ALIYUN_COM_GPU_MEM_IDX" // 共享 gpu 的 index, 由 scheduler extender 标记在 annotation
+	EnvMemPod                = "ALIYUN_COM_GPU_MEM_POD"
+	EnvMemContainer          = "ALIYUN_COM_GPU_MEM_CONTAINER"
+	EnvMemDev                = "ALIYUN_COM_GPU_MEM_DEV"
+	EnvMemUnit               = "ALIYUN_COM_GPU_MEM_UNIT"
+	EnvMemAssignedFlag       = "ALIYUN_COM_GPU_MEM_ASSIGNED"
+	EnvMemAssignedContainers = "ALIYUN_COM_GPU_MEM_ASSIGNED_CONTAINERS"
+	EnvMemAssumeTime         = "ALIYUN_COM_GPU_MEM_ASSUME_TIME"
+
+	MIGResourcePrefix = "aliyun.com/mig-" // 后接 MIG profile, 如 aliyun.com/mig-1g.5gb
 )
@@ -0,0 +1,193 @@
+package nvidia
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/golang/glog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var (
+	// driverControlDevices are shared by every container using a gpu.
+	driverControlDevices = []string{
+		"/dev/nvidiactl",
+		"/dev/nvidia-uvm",
+		"/dev/nvidia-uvm-tools",
+		"/dev/nvidia-modeset",
+	}
+
+	// driverMIGCapDevices are the capability devices giving access to the
+	// MIG instances.
+	driverMIGCapDevices = "/dev/nvidia-caps/nvidia-cap*"
+
+	driverLibraryDirs = []string{
+		"/usr/lib64",
+		"/usr/lib/x86_64-linux-gnu",
+		"/usr/lib/aarch64-linux-gnu",
+		"/usr/lib",
+		"/lib64",
+		"/lib/x86_64-linux-gnu",
+		"/usr/local/nvidia/lib64",
+	}
+
+	driverLibraries = []string{
+		"libnvidia-ml.so*",
+		"libcuda.so*",
+		"libnvidia-ptxjitcompiler.so*",
+		"libnvidia-fatbinaryloader.so*",
+		"libnvidia-opencl.so*",
+		"libnvidia-compiler.so*",
+		"libnvcuvid.so*",
+		"libnvidia-encode.so*",
+	}
+
+	driverBinaryDirs = []string{
+		"/usr/bin",
+		"/usr/local/bin",
+		"/usr/local/nvidia/bin",
+	}
+
+	driverBinaries = []string{
+		"nvidia-smi",
+		"nvidia-debugdump",
+		"nvidia-persistenced",
+		"nvidia-cuda-mps-control",
+		"nvidia-cuda-mps-server",
+	}
+)
+
+// driverFiles are the driver devices, libraries and binaries found on the
+// host. Paths are relative to the driver root, e.g. /usr/bin/nvidia-smi.
+type driverFiles struct {
+	hostRoot       string
+	controlDevices []string
+	migCapDevices  []string
+	files          []string
+}
+
+// discoverDriver looks for the driver files under root, which is where the
+// plugin sees the driver root of the host. hostRoot is the driver root as seen
+// by the container runtime.
+func discoverDriver(root, hostRoot string) (*driverFiles, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("invalid driver root: %v", err)
+	}
+
+	d := &driverFiles{hostRoot: hostRoot}
+	for _, dev := range driverControlDevices {
+		if _, err := os.Stat(filepath.Join(root, dev)); err == nil {
+			d.controlDevices = append(d.controlDevices, dev)
+		}
+	}
+
+	caps, err := filepath.Glob(filepath.Join(root, driverMIGCapDevices))
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range caps {
+		rel, err := filepath.Rel(root, dev)
+		if err != nil {
+			return nil, err
+		}
+		d.migCapDevices = append(d.migCapDevices, "/"+rel)
+	}
+
+	seen := map[string]bool{}
+	found := func(dirs, patterns []string) error {
+		for _, dir := range dirs {
+			for _, pattern := range patterns {
+				matches, err := filepath.Glob(filepath.Join(root, dir, pattern))
+				if err != nil {
+					return err
+				}
+				for _, match := range matches {
+					rel, err := filepath.Rel(root, match)
+					if err != nil {
+						return err
+					}
+					file := "/" + rel
+					if !seen[file] {
+						seen[file] = true
+						d.files = append(d.files, file)
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := found(driverLibraryDirs, driverLibraries); err != nil {
+		return nil, err
+	}
+	if err := found(driverBinaryDirs, driverBinaries); err != nil {
+		return nil, err
+	}
+	sort.Strings(d.files)
+
+	if len(d.controlDevices) == 0 || len(d.files) == 0 {
+		return nil, fmt.Errorf("no nvidia driver found under %s", root)
+	}
+	log.Infof("Found nvidia driver under %s: devices %v, files %v", root, d.controlDevices, d.files)
+	return d, nil
+}
+
+func (d *driverFiles) hostPath(path string) string {
+	return filepath.Join(d.hostRoot, path)
+}
+
+// deviceSpecs returns the device nodes of the given gpus followed by the
+// control devices.
+func (d *driverFiles) deviceSpecs(gpus []*GPUDevice) []*pluginapi.DeviceSpec {
+	var specs []*pluginapi.DeviceSpec
+	paths := []string{}
+	for _, gpu := range gpus {
+		paths = append(paths, gpu.Path)
+	}
+	for _, path := range append(paths, d.controlDevices...) {
+		specs = append(specs, &pluginapi.DeviceSpec{
+			ContainerPath: path,
+			HostPath:      d.hostPath(path),
+			Permissions:   "rw",
+		})
+	}
+	return specs
+}
+
+// migDeviceSpecs returns the device nodes of the MIG instances carved out of
+// the given gpus: the gpus, the control devices and, read only, the MIG
+// capability devices.
+func (d *driverFiles) migDeviceSpecs(parents []*GPUDevice) []*pluginapi.DeviceSpec {
+	seen := map[string]bool{}
+	gpus := []*GPUDevice{}
+	for _, gpu := range parents {
+		if !seen[gpu.UUID] {
+			seen[gpu.UUID] = true
+			gpus = append(gpus, gpu)
+		}
+	}
+	specs := d.deviceSpecs(gpus)
+	for _, path := range d.migCapDevices {
+		specs = append(specs, &pluginapi.DeviceSpec{
+			ContainerPath: path,
+			HostPath:      d.hostPath(path),
+			Permissions:   "r",
+		})
+	}
+	return specs
+}
+
+// mounts bind the driver libraries and binaries read only at the path they
+// have on the host.
+func (d *driverFiles) mounts() []*pluginapi.Mount {
+	var mounts []*pluginapi.Mount
+	for _, file := range d.files {
+		mounts = append(mounts, &pluginapi.Mount{
+			ContainerPath: file,
+			HostPath:      d.hostPath(file),
+			ReadOnly:      true,
+		})
+	}
+	return mounts
+}
@@ -0,0 +1,75 @@
+package nvidia
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventComponent = "gputopology-device-plugin"
+
+// Reasons of the events the plugin records.
+const (
+	reasonGPUAssigned         = "GPUAssigned"
+	reasonGPUTopologySelected = "GPUTopologySelected"
+	reasonGPUAssignFailed     = "GPUAssignFailed"
+	reasonNoGPUPod            = "NoGPUPodFound"
+	reasonPodCacheMiss        = "GPUPodCacheMiss"
+	reasonUnknownGPU          = "UnknownGPUDevice"
+	reasonAssumeExpired       = "GPUAssumeExpired"
+	reasonGPUNotReady         = "GPUNotReady"
+	reasonGPUUnhealthy        = "GPUUnhealthy"
+	reasonGPURecovered        = "GPURecovered"
+)
+
+// eventRecorder records events through the client-go event broadcaster,
+// which sends them in the background and aggregates repeated ones.
+type eventRecorder struct {
+	record.EventRecorder
+	kube        *KubeClient
+	broadcaster record.EventBroadcaster
+}
+
+func newEventRecorder(kube *KubeClient) *eventRecorder {
+	broadcaster := record.NewBroadcaster()
+	return &eventRecorder{
+		EventRecorder: broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{
+			Component: eventComponent,
+			Host:      kube.NodeName,
+		}),
+		kube:        kube,
+		broadcaster: broadcaster,
+	}
+}
+
+// run sends the recorded events to the API server until stop is closed.
+func (r *eventRecorder) run(stop <-chan struct{}) {
+	sink := &typedcorev1.EventSinkImpl{Interface: r.kube.Clientset.CoreV1().Events("")}
+	watcher := r.broadcaster.StartRecordingToSink(sink)
+	<-stop
+	watcher.Stop()
+}
+
+// podRef is the object of events about pod.
+func podRef(pod *v1.Pod) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:            "Pod",
+		APIVersion:      "v1",
+		Namespace:       pod.Namespace,
+		Name:            pod.Name,
+		UID:             pod.UID,
+		ResourceVersion: pod.ResourceVersion,
+	}
+}
+
+// nodeRef is the object of events about the node, named the way kubelet
+// names them.
+func (r *eventRecorder) nodeRef() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind: "Node",
+		Name: r.kube.NodeName,
+		UID:  types.UID(r.kube.NodeName),
+	}
+}
@@ -0,0 +1,122 @@
+package nvidia
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	minAssumeGCPeriod = 10 * time.Second
+	// ledgerReconcilePeriod is how often the entries of the pods gone are
+	// dropped from the ledger.
+	ledgerReconcilePeriod = 5 * time.Minute
+)
+
+// reconcileLedgerPeriodically reconciles the allocation ledger until stop is
+// closed, starting right away.
+func (m *NvidiaDevicePlugin) reconcileLedgerPeriodically(stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := m.reconcileLedger(context.Background()); err != nil {
+			log.Warningf("Failed to reconcile the allocation ledger: %v", err)
+		}
+	}, ledgerReconcilePeriod, stop)
+}
+
+// collectStaleAssumedPods clears, until stop is closed, the gpu assumption of
+// the pods the scheduler extender assumed longer than the assume timeout ago
+// which never got their gpus allocated.
+func (m *NvidiaDevicePlugin) collectStaleAssumedPods(stop <-chan struct{}) {
+	timeout := m.opts.AssumeTimeout
+	if timeout <= 0 {
+		return
+	}
+	period := timeout / 2
+	if period < minAssumeGCPeriod {
+		period = minAssumeGCPeriod
+	}
+
+	wait.Until(func() {
+		if err := m.clearStaleAssumptions(context.Background(), time.Now().Add(-timeout)); err != nil {
+			log.Warningf("Failed to collect stale assumed pods: %v", err)
+		}
+	}, period, stop)
+}
+
+// clearStaleAssumptions clears the assumption of the assumed pods on the node
+// which were assumed before deadline. It takes no lock: the patches fail on
+// a conflict when an allocation updated the pod meanwhile, and an allocation
+// patching after them restores the gpus it handed out.
+func (m *NvidiaDevicePlugin) clearStaleAssumptions(ctx context.Context, deadline time.Time) error {
+	pods, err := m.pods.list(ctx, v1.PodPending)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		if !isGPUAssumedPod(pod) {
+			continue
+		}
+		// Some containers got their gpus already, kubelet is still at it.
+		if pod.ObjectMeta.Annotations[EnvAssignedContainers] != "" {
+			continue
+		}
+		// Kubelet admits a bound pod, and so allocates its gpus, before it
+		// reports any container status.
+		if pod.Spec.NodeName != "" && len(pod.Status.ContainerStatuses) == 0 {
+			log.V(4).Infof("Pod %s in ns %s is waiting on its allocation, keeping its gpu assumption", pod.Name, pod.Namespace)
+			continue
+		}
+		value := pod.ObjectMeta.Annotations[EnvResourceAssumeTime]
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Warningf("Keeping the gpu assumption of pod %s in ns %s, invalid assume time %q: %v", pod.Name, pod.Namespace, value, err)
+			continue
+		}
+		assumed := time.Unix(0, nanos)
+		if assumed.After(deadline) {
+			continue
+		}
+
+		updated, err := clearPodAssumption(m.kube, pod)
+		if err != nil {
+			log.Warningf("Failed to clear the gpu assumption of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+			continue
+		}
+		m.pods.assume(updated)
+
+		message := fmt.Sprintf("GPUs %s assumed at %s were never allocated by kubelet, released them",
+			pod.ObjectMeta.Annotations[EnvResourceIndex],
+			assumed.Format(time.RFC3339))
+		log.Infof("Pod %s in ns %s: %s", pod.Name, pod.Namespace, message)
+		m.recorder.Event(podRef(updated), v1.EventTypeWarning, reasonAssumeExpired, message)
+	}
+	return nil
+}
+
+// clearPodAssumption removes the gpus and the assume time from the pod, so
+// it is no allocation candidate any more. The patch fails with a conflict if
+// the pod changed meanwhile, it is then looked at again on the next run.
+func clearPodAssumption(kube *KubeClient, pod *v1.Pod) (*v1.Pod, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": pod.ResourceVersion,
+			"annotations": map[string]interface{}{
+				EnvResourceIndex:      nil,
+				EnvResourceAssumeTime: nil,
+				EnvAssignedFlag:       nil,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kube.Clientset.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch)
+}
@@ -3,39 +3,83 @@ package nvidia
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"syscall"
 
-	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	"github.com/fsnotify/fsnotify"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
 )
 
-type GPUManager struct{}
+// GPUManager runs the device plugin and keeps it registered with kubelet.
+type GPUManager struct {
+	backend Backend
+	kube    *KubeClient
+	opts    *Options
+}
+
+// NewGPUManager returns a GPUManager serving the GPUs of backend.
+func NewGPUManager(backend Backend, kube *KubeClient, opts *Options) *GPUManager {
+	return &GPUManager{
+		backend: backend,
+		kube:    kube,
+		opts:    opts,
+	}
+}
 
-func Run() error {
+// Run builds the plugin dependencies from the environment and serves with
+// opts until the process is asked to shut down.
+func Run(opts *Options) error {
+	kube, err := NewKubeClientFromEnv()
+	if err != nil {
+		log.Printf("Failed to create the kubernetes client: %s.", err)
+		os.Exit(1)
+	}
+
+	backend, err := NewBackendFromEnv()
+	if err != nil {
+		log.Printf("Failed to create the gpu backend: %s.", err)
+		os.Exit(1)
+	}
 
+	if err := NewGPUManager(backend, kube, opts).Run(nil); err != nil {
+		log.Printf("Failed to run the device plugin: %s.", err)
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// Run serves the device plugin, registering it again whenever kubelet
+// recreates its socket, until stop is closed or a termination signal arrives.
+func (g *GPUManager) Run(stop <-chan struct{}) error {
 	log.Println("Loading NVML")
-	if err := nvml.Init(); err != nil {
+	if err := g.backend.Init(); err != nil {
 		log.Printf("Failed to initialize NVML: %s.", err)
 		log.Printf("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
 		log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
 		log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
 
-		select {}
+		<-stop
+		return err
 	}
-	defer func() { log.Println("Shutdown of NVML returned:", nvml.Shutdown()) }()
+	defer func() { log.Println("Shutdown of NVML returned:", g.backend.Shutdown()) }()
 
 	log.Println("Fetching devices.")
-	if len(getDevices()) == 0 {
+	registry, err := newDeviceRegistry(g.backend)
+	if err != nil {
+		log.Printf("Failed to fetch devices: %s.", err)
+		return err
+	}
+	if registry.Len() == 0 {
 		log.Println("No devices found. Waiting indefinitely.")
-		select {}
+		<-stop
+		return nil
 	}
 
 	log.Println("Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+	watcher, err := newFSWatcher(g.opts.DevicePluginPath)
 	if err != nil {
 		log.Println("Failed to created FS watcher.")
-		os.Exit(1)
+		return err
 	}
 	defer watcher.Close()
 
@@ -52,7 +96,7 @@ L:
 				devicePlugin.Stop()
 			}
 
-			devicePlugin = NewNvidiaDevicePlugin()
+			devicePlugin = NewNvidiaDevicePlugin(g.backend, g.kube, g.opts)
 			if err := devicePlugin.Serve(); err != nil {
 				log.Println("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
 				log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
@@ -64,8 +108,8 @@ L:
 
 		select {
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
+			if event.Name == g.opts.kubeletSocket() && event.Op&fsnotify.Create == fsnotify.Create {
+				log.Printf("inotify: %s created, restarting.", filepath.Base(event.Name))
 				restart = true
 			}
 
@@ -82,6 +126,11 @@ L:
 				devicePlugin.Stop()
 				break L
 			}
+
+		case <-stop:
+			log.Println("Stopped, shutting down.")
+			devicePlugin.Stop()
+			break L
 		}
 	}
 
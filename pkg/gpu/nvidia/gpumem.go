@@ -0,0 +1,198 @@
+package nvidia
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	memorySockName = "gputopology-mem.sock"
+	// memoryDeviceSeparator joins the gpu UUID and the unit number into the
+	// id of a memory device.
+	memoryDeviceSeparator = "-_-"
+	// maxListAndWatchSize is the default gRPC limit of the messages kubelet
+	// receives, a bigger device list never reaches it.
+	maxListAndWatchSize = 4 * 1024 * 1024
+)
+
+// MemoryDevicePlugin advertises every gpu as one aliyun.com/gpu-mem device
+// per memory unit, so several pods can share a gpu. It serves next to the
+// NvidiaDevicePlugin handing out whole gpus and shares its devices, pods and
+// lock.
+type MemoryDevicePlugin struct {
+	*subPlugin
+	gpu *NvidiaDevicePlugin
+}
+
+func newMemoryDevicePlugin(gpu *NvidiaDevicePlugin) (*MemoryDevicePlugin, error) {
+	m := &MemoryDevicePlugin{
+		subPlugin: newSubPlugin(gpu.opts.memorySocket(), MemoryResourceName),
+		gpu:       gpu,
+	}
+	if err := m.checkSize(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkSize fails when the memory devices are too many for kubelet to
+// receive their list, e.g. in MiB units on many large gpus. The list is
+// measured with every device unhealthy, its longest form.
+func (m *MemoryDevicePlugin) checkSize() error {
+	devs := m.devices()
+	for _, d := range devs {
+		d.Health = pluginapi.Unhealthy
+	}
+	size := (&pluginapi.ListAndWatchResponse{Devices: devs}).Size()
+	if size > maxListAndWatchSize {
+		return fmt.Errorf("%d gpu memory devices in %s take %d bytes, more than the %d bytes kubelet receives, use a larger memory unit",
+			len(devs),
+			m.gpu.opts.MemoryUnit,
+			size,
+			maxListAndWatchSize)
+	}
+	return nil
+}
+
+func memoryDeviceID(uuid string, unit int) string {
+	return fmt.Sprintf("%s%s%d", uuid, memoryDeviceSeparator, unit)
+}
+
+// memoryDeviceGPU returns the UUID of the gpu of a memory device.
+func memoryDeviceGPU(id string) string {
+	if i := strings.LastIndex(id, memoryDeviceSeparator); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// memoryUnits is the number of memory devices of dev.
+func (m *MemoryDevicePlugin) memoryUnits(dev *GPUDevice) int {
+	return int(dev.Memory / m.gpu.opts.memoryUnitMiB())
+}
+
+// devices lists the memory devices, which are as healthy as their gpu. The
+// gpus split in MIG instances have none.
+func (m *MemoryDevicePlugin) devices() []*pluginapi.Device {
+	m.gpu.RLock()
+	defer m.gpu.RUnlock()
+
+	devs := []*pluginapi.Device{}
+	for i, d := range m.gpu.registry.Devices() {
+		if m.gpu.migParents[i] {
+			continue
+		}
+		gpu := m.gpu.devs[i]
+		for unit := 0; unit < m.memoryUnits(d); unit++ {
+			devs = append(devs, &pluginapi.Device{
+				ID:       memoryDeviceID(d.UUID, unit),
+				Health:   gpu.Health,
+				Topology: gpu.Topology,
+			})
+		}
+	}
+	return devs
+}
+
+func (m *MemoryDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{
+		GetPreferredAllocationAvailable: true,
+	}, nil
+}
+
+// ListAndWatch lists the memory devices and sends them again whenever the
+// health of a gpu changes.
+func (m *MemoryDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return m.listAndWatch(s)
+}
+
+// GetPreferredAllocation keeps the memory of a container on a single gpu,
+// the fullest one it fits on, so the emptier gpus stay free for bigger pods.
+func (m *MemoryDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	responses := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		response := &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: m.preferredDevices(req),
+		}
+		if len(response.DeviceIDs) == 0 {
+			log.Warningf("No single gpu holds %d memory units out of %d available", req.AllocationSize, len(req.AvailableDeviceIDs))
+		}
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	return responses, nil
+}
+
+func (m *MemoryDevicePlugin) preferredDevices(req *pluginapi.ContainerPreferredAllocationRequest) []string {
+	return preferSingleGPU(req, func(id string) (int, bool) {
+		d, ok := m.gpu.registry.ByUUID(memoryDeviceGPU(id))
+		if !ok {
+			return 0, false
+		}
+		return int(d.Index), true
+	})
+}
+
+func (m *MemoryDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// Serve starts the gRPC server and registers the memory resource with Kubelet.
+func (m *MemoryDevicePlugin) Serve() error {
+	return m.serve(m, m.gpu.opts.kubeletSocket())
+}
+
+// getMemoryUnitsFromContainer returns the memory units a container asks for.
+func getMemoryUnitsFromContainer(container *v1.Container) uint {
+	if val, ok := container.Resources.Limits[MemoryResourceName]; ok {
+		return uint(val.Value())
+	}
+	return 0
+}
+
+// getMemoryContainers returns the containers of the pod asking for gpu
+// memory, in spec order.
+func getMemoryContainers(pod *v1.Pod) []v1.Container {
+	containers := []v1.Container{}
+	for _, container := range pod.Spec.Containers {
+		if getMemoryUnitsFromContainer(&container) > 0 {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+// getPendingMemoryContainers returns the memory containers of the pod which
+// have not been allocated yet.
+func getPendingMemoryContainers(pod *v1.Pod) []v1.Container {
+	assigned := map[string]bool{}
+	for _, name := range strings.Split(pod.ObjectMeta.Annotations[EnvMemAssignedContainers], ",") {
+		assigned[name] = true
+	}
+
+	containers := []v1.Container{}
+	for _, container := range getMemoryContainers(pod) {
+		if !assigned[container.Name] {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+// matchMemoryContainers is matchGPUContainers for memory units.
+func matchMemoryContainers(pod *v1.Pod, reqs *pluginapi.AllocateRequest) ([]v1.Container, bool) {
+	pending := getPendingMemoryContainers(pod)
+	if len(reqs.ContainerRequests) == 0 || len(reqs.ContainerRequests) > len(pending) {
+		return nil, false
+	}
+	for i, req := range reqs.ContainerRequests {
+		if getMemoryUnitsFromContainer(&pending[i]) != uint(len(req.DevicesIDs)) {
+			return nil, false
+		}
+	}
+	return pending[:len(reqs.ContainerRequests)], true
+}
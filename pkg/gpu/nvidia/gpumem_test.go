@@ -0,0 +1,39 @@
+package nvidia
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryCheckSize(t *testing.T) {
+	fixture := &FakeFixture{}
+	for i := 0; i < 8; i++ {
+		fixture.GPUs = append(fixture.GPUs, FakeGPU{
+			UUID:   fmt.Sprintf("GPU-%08d-0000-0000-0000-000000000000", i),
+			Memory: 81920,
+		})
+	}
+	backend, err := NewFakeBackend(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := newDeviceRegistry(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for unit, fits := range map[string]bool{GiBMemoryUnit: true, MiBMemoryUnit: false} {
+		gpu := &NvidiaDevicePlugin{
+			devs:     registry.pluginDevices(),
+			registry: registry,
+			opts:     &Options{MemoryUnit: unit},
+		}
+		_, err := newMemoryDevicePlugin(gpu)
+		if fits && err != nil {
+			t.Errorf("expected 8 80GB gpus in %s to fit, got %v", unit, err)
+		}
+		if !fits && err == nil {
+			t.Errorf("expected 8 80GB gpus in %s not to fit", unit)
+		}
+	}
+}
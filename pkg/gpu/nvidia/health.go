@@ -0,0 +1,308 @@
+package nvidia
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// maxHealthHistory bounds the transitions remembered for every gpu.
+	maxHealthHistory = 20
+	// maxFlapShift caps the doubling of the recovery period of flapping gpus.
+	maxFlapShift = 6
+	// minRecoveryInterval and maxRecoveryInterval bound how often the
+	// unhealthy gpus are checked for recovery.
+	minRecoveryInterval = 100 * time.Millisecond
+	maxRecoveryInterval = 10 * time.Second
+)
+
+// healthEvent reports a problem with a gpu.
+type healthEvent struct {
+	dev    *pluginapi.Device
+	reason string
+	// permanent problems are never recovered from, e.g. a gpu too old for
+	// health checking.
+	permanent bool
+	// untilReboot problems are permanent and outlive restarts of the
+	// plugin, e.g. a gpu fallen off the bus.
+	untilReboot bool
+	// ongoing problems are reported again as long as they last, e.g. a gpu
+	// staying too hot. They only count once towards flapping.
+	ongoing bool
+}
+
+// healthTransition is a change of the health of a gpu.
+type healthTransition struct {
+	Time   time.Time `json:"time"`
+	Health string    `json:"health"`
+	Reason string    `json:"reason"`
+}
+
+// gpuHealth is the health state of one gpu.
+type gpuHealth struct {
+	healthy   bool
+	permanent bool
+	reason    string
+	// lastEvent is the time of the latest problem, the quiet period starts
+	// from it.
+	lastEvent time.Time
+	// events are the times of the problems within the flap window.
+	events  []time.Time
+	history []healthTransition
+}
+
+// healthTracker runs the health state machine of the gpus: a gpu turns
+// unhealthy on its first problem and healthy again once it stayed quiet for
+// the recovery period, which doubles with every problem beyond the flap
+// threshold within the flap window.
+type healthTracker struct {
+	opts *Options
+	gpus map[string]*gpuHealth
+}
+
+func newHealthTracker(opts *Options) *healthTracker {
+	return &healthTracker{
+		opts: opts,
+		gpus: map[string]*gpuHealth{},
+	}
+}
+
+func (t *healthTracker) gpu(id string) *gpuHealth {
+	g, ok := t.gpus[id]
+	if !ok {
+		g = &gpuHealth{healthy: true}
+		t.gpus[id] = g
+	}
+	return g
+}
+
+// unhealthy records a problem of the gpu at now and reports whether the gpu
+// just turned unhealthy.
+func (t *healthTracker) unhealthy(e healthEvent, now time.Time) bool {
+	g := t.gpu(e.dev.ID)
+	g.lastEvent = now
+	g.permanent = g.permanent || e.permanent || e.untilReboot
+	if e.ongoing && !g.healthy {
+		return false
+	}
+
+	events := g.events[:0]
+	for _, at := range g.events {
+		if now.Sub(at) < t.opts.HealthFlapWindow {
+			events = append(events, at)
+		}
+	}
+	g.events = append(events, now)
+
+	if !g.healthy {
+		return false
+	}
+	g.healthy = false
+	g.reason = e.reason
+	g.record(now, pluginapi.Unhealthy, e.reason)
+	return true
+}
+
+// holdTime is how long the gpu must stay quiet before it recovers.
+func (t *healthTracker) holdTime(g *gpuHealth) time.Duration {
+	hold := t.opts.HealthRecoveryPeriod
+	if t.opts.HealthFlapThreshold <= 0 || len(g.events) < t.opts.HealthFlapThreshold {
+		return hold
+	}
+	shift := uint(len(g.events) - t.opts.HealthFlapThreshold + 1)
+	if shift > maxFlapShift {
+		shift = maxFlapShift
+	}
+	return hold << shift
+}
+
+// due returns the ids of the unhealthy gpus which stayed quiet long enough
+// to recover at now.
+func (t *healthTracker) due(now time.Time) []string {
+	if t.opts.HealthRecoveryPeriod <= 0 {
+		return nil
+	}
+	ids := []string{}
+	for id, g := range t.gpus {
+		if !g.healthy && !g.permanent && now.Sub(g.lastEvent) >= t.holdTime(g) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// recovered marks the gpu healthy again at now.
+func (t *healthTracker) recovered(id, reason string, now time.Time) {
+	g := t.gpu(id)
+	g.healthy = true
+	g.reason = ""
+	g.record(now, pluginapi.Healthy, reason)
+}
+
+// history returns copies of the transitions of the gpus, by gpu id.
+func (t *healthTracker) history() map[string][]healthTransition {
+	history := map[string][]healthTransition{}
+	for id, g := range t.gpus {
+		if len(g.history) > 0 {
+			history[id] = append([]healthTransition{}, g.history...)
+		}
+	}
+	return history
+}
+
+func (g *gpuHealth) record(now time.Time, health, reason string) {
+	g.history = append(g.history, healthTransition{Time: now, Health: health, Reason: reason})
+	if len(g.history) > maxHealthHistory {
+		g.history = g.history[len(g.history)-maxHealthHistory:]
+	}
+}
+
+// markUnhealthy feeds a problem to the health state machine and reports
+// whether the gpu turned unhealthy.
+func (m *NvidiaDevicePlugin) markUnhealthy(e healthEvent) bool {
+	m.Lock()
+	changed := m.healthState.unhealthy(e, time.Now())
+	if changed {
+		e.dev.Health = pluginapi.Unhealthy
+	}
+	m.Unlock()
+
+	if e.untilReboot {
+		if err := m.rebootMarks.mark(e.dev.ID, e.reason); err != nil {
+			log.Warningf("Failed to keep GPU %s unhealthy until reboot: %v", e.dev.ID, err)
+		}
+	}
+
+	if !changed {
+		log.V(4).Infof("GPU %s is still unhealthy: %s", e.dev.ID, e.reason)
+		return false
+	}
+	index := m.gpuIndex(e.dev.ID)
+	log.Warningf("GPU %s (%s) is unhealthy: %s", index, e.dev.ID, e.reason)
+	m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeWarning, reasonGPUUnhealthy,
+		"GPU %s is unhealthy: %s", index, e.reason)
+	go m.publishHealthHistory()
+	return true
+}
+
+// restoreRebootMarks marks the gpus unhealthy which were marked unhealthy
+// until reboot since the node booted, before the plugin restarted.
+func (m *NvidiaDevicePlugin) restoreRebootMarks() {
+	for id, reason := range m.rebootMarks.list() {
+		dev := m.device(id)
+		if dev == nil {
+			continue
+		}
+		m.markUnhealthy(healthEvent{dev: dev, reason: reason, untilReboot: true})
+	}
+}
+
+// recoverDevices turns the unhealthy gpus which stayed quiet long enough,
+// and answer the driver when probing, healthy again. It reports whether any
+// gpu recovered.
+func (m *NvidiaDevicePlugin) recoverDevices() bool {
+	m.RLock()
+	due := m.healthState.due(time.Now())
+	m.RUnlock()
+
+	recovered := false
+	for _, id := range due {
+		dev := m.device(id)
+		if dev == nil {
+			continue
+		}
+		index := m.gpuIndex(id)
+		if err := m.probe(id); err != nil {
+			m.markUnhealthy(healthEvent{dev: dev, reason: fmt.Sprintf("probe failed: %v", err)})
+			log.Warningf("GPU %s (%s) stays unhealthy, probe failed: %v", index, id, err)
+			continue
+		}
+
+		m.Lock()
+		reason := fmt.Sprintf("quiet since %s", m.healthState.gpu(id).lastEvent.Format(time.RFC3339))
+		m.healthState.recovered(id, reason, time.Now())
+		dev.Health = pluginapi.Healthy
+		m.Unlock()
+
+		log.Infof("GPU %s (%s) is healthy again, %s", index, id, reason)
+		m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeNormal, reasonGPURecovered,
+			"GPU %s is healthy again, %s", index, reason)
+		recovered = true
+	}
+	if recovered {
+		go m.publishHealthHistory()
+	}
+	return recovered
+}
+
+// publishHealthHistory writes the latest health transitions of the gpus, by
+// gpu index, to the GPU_HEALTH_HISTORY annotation of the node.
+func (m *NvidiaDevicePlugin) publishHealthHistory() {
+	m.historyPatches.Lock()
+	defer m.historyPatches.Unlock()
+
+	m.RLock()
+	history := m.healthState.history()
+	m.RUnlock()
+
+	byIndex := map[string][]healthTransition{}
+	for id, transitions := range history {
+		byIndex[m.gpuIndex(id)] = transitions
+	}
+	value, err := json.Marshal(byIndex)
+	if err != nil {
+		log.Warningf("Failed to encode the gpu health history: %v", err)
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				EnvHealthHistoryKey: string(value),
+			},
+		},
+	})
+	if err != nil {
+		log.Warningf("Failed to encode the gpu health history: %v", err)
+		return
+	}
+	if _, err := m.kube.Clientset.CoreV1().Nodes().Patch(m.kube.NodeName, types.MergePatchType, patch); err != nil {
+		log.Warningf("Failed to publish the gpu health history on node %s: %v", m.kube.NodeName, err)
+	}
+}
+
+// probe checks that a recovering gpu answers the driver.
+func (m *NvidiaDevicePlugin) probe(id string) error {
+	if !m.opts.HealthProbe {
+		return nil
+	}
+	d, ok := m.registry.ByUUID(id)
+	if !ok {
+		return fmt.Errorf("unknown gpu %s", id)
+	}
+	_, err := m.backend.ComputeProcesses(d)
+	return err
+}
+
+// device returns the advertised gpu with the given id.
+func (m *NvidiaDevicePlugin) device(id string) *pluginapi.Device {
+	for _, d := range m.devs {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// gpuIndex names the gpu with the given id by index in messages.
+func (m *NvidiaDevicePlugin) gpuIndex(id string) string {
+	if d, ok := m.registry.ByUUID(id); ok {
+		return fmt.Sprintf("%d", d.Index)
+	}
+	return id
+}
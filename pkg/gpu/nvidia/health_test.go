@@ -0,0 +1,99 @@
+package nvidia
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestHealthTrackerFlapping(t *testing.T) {
+	tracker := newHealthTracker(&Options{
+		HealthRecoveryPeriod: time.Minute,
+		HealthFlapWindow:     10 * time.Minute,
+		HealthFlapThreshold:  3,
+	})
+	dev := &pluginapi.Device{ID: "GPU-0"}
+	start := time.Unix(0, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	// fail turns the gpu unhealthy at d and checks when it is due to recover.
+	fail := func(d, hold time.Duration) {
+		if !tracker.unhealthy(healthEvent{dev: dev, reason: "xid"}, at(d)) {
+			t.Fatalf("expected gpu to turn unhealthy at %v", d)
+		}
+		if due := tracker.due(at(d + hold - time.Second)); len(due) != 0 {
+			t.Errorf("expected gpu to stay unhealthy before %v after %v, got due %v", hold, d, due)
+		}
+		if due := tracker.due(at(d + hold)); !reflect.DeepEqual(due, []string{"GPU-0"}) {
+			t.Errorf("expected gpu due %v after %v, got %v", hold, d, due)
+		}
+		tracker.recovered("GPU-0", "quiet", at(d+hold))
+	}
+
+	fail(0, time.Minute)
+	fail(2*time.Minute, time.Minute)
+	// The third event within the window doubles the hold, the fourth
+	// doubles it again.
+	fail(4*time.Minute, 2*time.Minute)
+	fail(7*time.Minute, 4*time.Minute)
+	// The earlier events all left the window.
+	fail(18*time.Minute+30*time.Second, time.Minute)
+
+	history := tracker.history()["GPU-0"]
+	if len(history) != 10 {
+		t.Fatalf("expected 10 transitions, got %d", len(history))
+	}
+	if last := history[9]; last.Health != pluginapi.Healthy || !last.Time.Equal(at(19*time.Minute+30*time.Second)) {
+		t.Errorf("unexpected last transition %+v", last)
+	}
+}
+
+func TestHealthTrackerOngoingAndPermanent(t *testing.T) {
+	tracker := newHealthTracker(&Options{
+		HealthRecoveryPeriod: time.Minute,
+		HealthFlapWindow:     10 * time.Minute,
+		HealthFlapThreshold:  2,
+	})
+	hot := &pluginapi.Device{ID: "GPU-0"}
+	old := &pluginapi.Device{ID: "GPU-1"}
+	start := time.Unix(0, 0)
+
+	if !tracker.unhealthy(healthEvent{dev: hot, reason: "hot", ongoing: true}, start) {
+		t.Fatal("expected the hot gpu to turn unhealthy")
+	}
+	// Reported again while it lasts: postpones the recovery but doesn't
+	// count as flapping.
+	for i := 1; i <= 5; i++ {
+		if tracker.unhealthy(healthEvent{dev: hot, reason: "hot", ongoing: true}, start.Add(time.Duration(i)*time.Minute)) {
+			t.Fatal("expected the hot gpu to stay unhealthy")
+		}
+	}
+	if !tracker.unhealthy(healthEvent{dev: old, reason: "too old", permanent: true}, start) {
+		t.Fatal("expected the old gpu to turn unhealthy")
+	}
+
+	if due := tracker.due(start.Add(5*time.Minute + 59*time.Second)); len(due) != 0 {
+		t.Errorf("expected no gpu due before the hot gpu cooled down, got %v", due)
+	}
+	due := tracker.due(start.Add(time.Hour))
+	sort.Strings(due)
+	if !reflect.DeepEqual(due, []string{"GPU-0"}) {
+		t.Errorf("expected only the hot gpu due, got %v", due)
+	}
+}
+
+func TestRecoveryInterval(t *testing.T) {
+	for period, expected := range map[time.Duration]time.Duration{
+		time.Nanosecond: minRecoveryInterval,
+		time.Second:     500 * time.Millisecond,
+		time.Hour:       maxRecoveryInterval,
+	} {
+		opts := &Options{HealthRecoveryPeriod: period}
+		if interval := opts.recoveryInterval(); interval != expected {
+			t.Errorf("expected interval %v for period %v, got %v", expected, period, interval)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package nvidia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/ghodss/yaml"
+	log "github.com/golang/glog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// The health checks, which DP_DISABLE_HEALTHCHECKS or the disabled list of
+// the health checks config turn off by name.
+const (
+	xidsHealthCheck        = "xids"
+	eccHealthCheck         = "ecc"
+	temperatureHealthCheck = "temperature"
+	throttleHealthCheck    = "throttle"
+	powerHealthCheck       = "power"
+
+	defaultHealthCheckInterval = 30 * time.Second
+)
+
+// healthChecksConfig is the health checks config file, e.g.
+//
+//	interval: 30s
+//	disabled: [power]
+//	ecc:
+//	  maxErrors: 0
+//	temperature:
+//	  max: 85
+//	  for: 60s
+//	throttle:
+//	  reasons: [HW Slowdown, HW Power Brake Slowdown]
+//	  for: 30s
+//
+// A check whose limit is unset is off, only the ecc check is on by default.
+type healthChecksConfig struct {
+	Interval    string              `json:"interval,omitempty"`
+	Disabled    []string            `json:"disabled,omitempty"`
+	ECC         eccCheckConfig      `json:"ecc,omitempty"`
+	Temperature limitCheckConfig    `json:"temperature,omitempty"`
+	Power       limitCheckConfig    `json:"power,omitempty"`
+	Throttle    throttleCheckConfig `json:"throttle,omitempty"`
+}
+
+// eccCheckConfig fails a gpu with more uncorrected ECC errors than
+// MaxErrors.
+type eccCheckConfig struct {
+	MaxErrors uint64 `json:"maxErrors,omitempty"`
+}
+
+// limitCheckConfig fails a gpu which stays above Max, in °C or W, for the
+// For duration.
+type limitCheckConfig struct {
+	Max uint   `json:"max,omitempty"`
+	For string `json:"for,omitempty"`
+}
+
+// throttleCheckConfig fails a gpu which stays throttled for one of the
+// Reasons, as nvidia-smi names them, for the For duration.
+type throttleCheckConfig struct {
+	Reasons []string `json:"reasons,omitempty"`
+	For     string   `json:"for,omitempty"`
+}
+
+// thresholdCheck is a resolved health check.
+type thresholdCheck struct {
+	name string
+	// sustain is how long the gpu must fail the check to turn unhealthy.
+	sustain time.Duration
+	// failed returns why the status fails the check, or "" when it passes.
+	failed func(*GPUStatus) string
+}
+
+// healthChecker runs the threshold health checks every interval.
+type healthChecker struct {
+	interval time.Duration
+	checks   []thresholdCheck
+	// failing is since when every gpu fails every check, by gpu id and
+	// check name.
+	failing map[string]map[string]time.Time
+}
+
+// loadHealthChecksConfig reads the health checks config file at path, the
+// defaults when path is empty.
+func loadHealthChecksConfig(path string) (*healthChecksConfig, error) {
+	config := &healthChecksConfig{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid health checks config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// newHealthChecker resolves the threshold checks of the config, leaving out
+// the disabled ones, which are comma separated names like
+// DP_DISABLE_HEALTHCHECKS.
+func newHealthChecker(config *healthChecksConfig, disabled string) (*healthChecker, error) {
+	off := map[string]bool{}
+	for _, name := range append(strings.Split(disabled, ","), config.Disabled...) {
+		off[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	c := &healthChecker{
+		interval: defaultHealthCheckInterval,
+		failing:  map[string]map[string]time.Time{},
+	}
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid health check interval %q", config.Interval)
+		}
+		c.interval = interval
+	}
+
+	if !off[eccHealthCheck] {
+		max := config.ECC.MaxErrors
+		c.checks = append(c.checks, thresholdCheck{
+			name: eccHealthCheck,
+			failed: func(st *GPUStatus) string {
+				if st.ECCErrors == nil || *st.ECCErrors <= max {
+					return ""
+				}
+				return fmt.Sprintf("%d uncorrected ECC errors", *st.ECCErrors)
+			},
+		})
+	}
+
+	if !off[temperatureHealthCheck] && config.Temperature.Max > 0 {
+		sustain, err := parseSustain(temperatureHealthCheck, config.Temperature.For)
+		if err != nil {
+			return nil, err
+		}
+		max := config.Temperature.Max
+		c.checks = append(c.checks, thresholdCheck{
+			name:    temperatureHealthCheck,
+			sustain: sustain,
+			failed: func(st *GPUStatus) string {
+				if st.Temperature == nil || *st.Temperature <= max {
+					return ""
+				}
+				return fmt.Sprintf("temperature %d°C above %d°C", *st.Temperature, max)
+			},
+		})
+	}
+
+	if !off[powerHealthCheck] && config.Power.Max > 0 {
+		sustain, err := parseSustain(powerHealthCheck, config.Power.For)
+		if err != nil {
+			return nil, err
+		}
+		max := config.Power.Max
+		c.checks = append(c.checks, thresholdCheck{
+			name:    powerHealthCheck,
+			sustain: sustain,
+			failed: func(st *GPUStatus) string {
+				if st.Power == nil || *st.Power <= max {
+					return ""
+				}
+				return fmt.Sprintf("power draw %dW above %dW", *st.Power, max)
+			},
+		})
+	}
+
+	if !off[throttleHealthCheck] && len(config.Throttle.Reasons) > 0 {
+		sustain, err := parseSustain(throttleHealthCheck, config.Throttle.For)
+		if err != nil {
+			return nil, err
+		}
+		reasons := map[nvml.ThrottleReason]bool{}
+		for _, name := range config.Throttle.Reasons {
+			reason, err := parseThrottleReason(name)
+			if err != nil {
+				return nil, err
+			}
+			reasons[reason] = true
+		}
+		c.checks = append(c.checks, thresholdCheck{
+			name:    throttleHealthCheck,
+			sustain: sustain,
+			failed: func(st *GPUStatus) string {
+				if !reasons[st.Throttle] {
+					return ""
+				}
+				return fmt.Sprintf("clocks throttled: %s", st.Throttle)
+			},
+		})
+	}
+	return c, nil
+}
+
+func parseSustain(check, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	sustain, err := time.ParseDuration(value)
+	if err != nil || sustain < 0 {
+		return 0, fmt.Errorf("invalid duration %q of the %s health check", value, check)
+	}
+	return sustain, nil
+}
+
+// parseThrottleReason parses a clock throttle reason as nvidia-smi names
+// it, e.g. "HW Slowdown". An empty name is no throttling.
+func parseThrottleReason(name string) (nvml.ThrottleReason, error) {
+	if name == "" {
+		return nvml.ThrottleReasonNone, nil
+	}
+	for reason := nvml.ThrottleReasonGpuIdle; reason <= nvml.ThrottleReasonNone; reason++ {
+		if strings.EqualFold(reason.String(), strings.TrimSpace(name)) {
+			return reason, nil
+		}
+	}
+	return nvml.ThrottleReasonUnknown, fmt.Errorf("unknown clock throttle reason %q", name)
+}
+
+// check runs the checks on the status of the gpu at now and returns the
+// problems of the checks it has failed long enough.
+func (c *healthChecker) check(dev *pluginapi.Device, st *GPUStatus, now time.Time) []healthEvent {
+	failing, ok := c.failing[dev.ID]
+	if !ok {
+		failing = map[string]time.Time{}
+		c.failing[dev.ID] = failing
+	}
+
+	events := []healthEvent{}
+	for _, check := range c.checks {
+		reason := check.failed(st)
+		if reason == "" {
+			delete(failing, check.name)
+			continue
+		}
+		since, ok := failing[check.name]
+		if !ok {
+			since = now
+			failing[check.name] = since
+		}
+		if now.Sub(since) < check.sustain {
+			log.V(4).Infof("GPU %s fails the %s health check since %s: %s", dev.ID, check.name, since.Format(time.RFC3339), reason)
+			continue
+		}
+		events = append(events, healthEvent{dev: dev, reason: reason, ongoing: true})
+	}
+	return events
+}
+
+// watchThresholds runs the threshold checks on every gpu each interval
+// until stop is closed. Gpus in MIG mode are left out, they don't report the
+// metrics.
+func (m *NvidiaDevicePlugin) watchThresholds(c *healthChecker, stop <-chan struct{}, events chan<- healthEvent) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		m.RLock()
+		devs := append([]*pluginapi.Device{}, m.devs...)
+		m.RUnlock()
+		for _, dev := range devs {
+			d, ok := m.registry.ByUUID(dev.ID)
+			if !ok || m.migParents[int(d.Index)] {
+				continue
+			}
+			st, err := m.backend.Status(d)
+			if err != nil {
+				log.Warningf("Failed to read the health metrics of GPU %d: %v", d.Index, err)
+				continue
+			}
+			for _, e := range c.check(dev, st, time.Now()) {
+				select {
+				case events <- e:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}
+}
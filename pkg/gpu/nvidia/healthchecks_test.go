@@ -0,0 +1,69 @@
+package nvidia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestHealthCheckerCheck(t *testing.T) {
+	c, err := newHealthChecker(&healthChecksConfig{
+		Temperature: limitCheckConfig{Max: 85, For: "60s"},
+		Throttle:    throttleCheckConfig{Reasons: []string{"HW Slowdown"}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &pluginapi.Device{ID: "GPU-0"}
+	start := time.Unix(0, 0)
+	temperature := func(celsius uint) *GPUStatus {
+		return &GPUStatus{Temperature: &celsius}
+	}
+	reasons := func(events []healthEvent) []string {
+		names := []string{}
+		for _, e := range events {
+			if !e.ongoing || e.dev != dev {
+				t.Errorf("unexpected event %+v", e)
+			}
+			names = append(names, e.reason)
+		}
+		return names
+	}
+
+	for _, step := range []struct {
+		after    time.Duration
+		status   *GPUStatus
+		expected int
+	}{
+		{0, temperature(90), 0},
+		{59 * time.Second, temperature(90), 0},
+		// Hot for the sustain period.
+		{60 * time.Second, temperature(90), 1},
+		{90 * time.Second, temperature(90), 1},
+		// Cooling down resets it.
+		{100 * time.Second, temperature(80), 0},
+		{110 * time.Second, temperature(90), 0},
+		{169 * time.Second, temperature(90), 0},
+		{170 * time.Second, temperature(90), 1},
+		// Throttling fails at once.
+		{180 * time.Second, &GPUStatus{Throttle: nvml.ThrottleReasonHwSlowdown}, 1},
+		{190 * time.Second, &GPUStatus{Throttle: nvml.ThrottleReasonNone}, 0},
+	} {
+		events := c.check(dev, step.status, start.Add(step.after))
+		if len(events) != step.expected {
+			t.Errorf("after %v expected %d events, got %v", step.after, step.expected, reasons(events))
+		}
+	}
+
+	// The ecc check is on by default and has no sustain.
+	errors := uint64(1)
+	if events := c.check(dev, &GPUStatus{ECCErrors: &errors}, start); len(events) != 1 {
+		t.Errorf("expected an ecc event, got %v", reasons(events))
+	}
+	// Every gpu has its own state.
+	if events := c.check(&pluginapi.Device{ID: "GPU-1"}, temperature(90), start.Add(time.Hour)); len(events) != 0 {
+		t.Errorf("expected GPU-1 to be hot for too short, got %v", reasons(events))
+	}
+}
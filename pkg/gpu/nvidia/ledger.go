@@ -0,0 +1,386 @@
+package nvidia
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ledgerName is the file of the allocation ledger in the device plugin dir.
+const ledgerName = "gputopology_ledger.json"
+
+// ledgerOwnerGrace is how long an entry of an unknown pod is kept in use
+// while kubelet has not checkpointed its devices yet.
+const ledgerOwnerGrace = time.Minute
+
+// ledgerEntry records the gpus handed to a container for the devices of a
+// resource kubelet asked for. The replica and MIG plugins don't know the
+// pod, their entries get it from the kubelet checkpoint on reconciliation.
+type ledgerEntry struct {
+	PodUID    types.UID `json:"podUID,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Container string    `json:"container,omitempty"`
+	// Resource defaults to aliyun.com/gpu.
+	Resource string `json:"resource,omitempty"`
+	// Devices are the device ids kubelet asked for.
+	Devices     []string  `json:"devices,omitempty"`
+	GPUs        []string  `json:"gpus"`
+	AllocatedAt time.Time `json:"allocatedAt"`
+}
+
+func (e *ledgerEntry) key() string {
+	if e.PodUID == "" {
+		return e.Resource + "/" + deviceSetKey(e.Devices)
+	}
+	return string(e.PodUID) + "/" + e.Container + "/" + e.Resource
+}
+
+// owner returns the pod and container kubelet checkpointed the devices of
+// the entry of an unknown pod for. The pod is empty when kubelet holds the
+// devices for no container any more. ok is false when that can't be told
+// yet: the checkpoint can't be read or the entry is too recent.
+func (e *ledgerEntry) owner(checkpoint *checkpointCache) (uid types.UID, container string, ok bool) {
+	devices, err := checkpoint.read(e.Resource)
+	if err != nil {
+		return "", "", false
+	}
+	if uid, container, ok := devices.owner(e.Devices); ok {
+		return uid, container, true
+	}
+	return "", "", time.Since(e.AllocatedAt) >= ledgerOwnerGrace
+}
+
+// allocationLedger is the on-disk record of the gpus allocated to the
+// containers of the node. Kubelet empties the device plugin dir when it
+// restarts, the ledger is rebuilt from the pods then.
+type allocationLedger struct {
+	path string
+
+	sync.Mutex
+	entries map[string]*ledgerEntry
+}
+
+// openLedger loads the ledger at path. A missing or unreadable ledger starts
+// empty, reconciliation fills it.
+func openLedger(path string) *allocationLedger {
+	l := &allocationLedger{
+		path:    path,
+		entries: map[string]*ledgerEntry{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read the allocation ledger %s: %v", path, err)
+		}
+		return l
+	}
+	entries := []*ledgerEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Warningf("Ignoring the corrupted allocation ledger %s: %v", path, err)
+		return l
+	}
+	for _, e := range entries {
+		if e.Resource == "" {
+			e.Resource = resourceName
+		}
+		l.entries[e.key()] = e
+	}
+	return l
+}
+
+// record adds the gpus allocated to container of pod for the devices of
+// resource and saves the ledger. pod is nil when it is unknown.
+func (l *allocationLedger) record(pod *v1.Pod, container, resource string, devices, uuids []string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	e := &ledgerEntry{
+		Container:   container,
+		Resource:    resource,
+		Devices:     devices,
+		GPUs:        uuids,
+		AllocatedAt: time.Now(),
+	}
+	if pod != nil {
+		e.PodUID, e.Namespace, e.Name = pod.UID, pod.Namespace, pod.Name
+	}
+	l.entries[e.key()] = e
+	return l.save()
+}
+
+// list returns the entries ordered by pod and container.
+func (l *allocationLedger) list() []*ledgerEntry {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.sorted()
+}
+
+func (l *allocationLedger) sorted() []*ledgerEntry {
+	entries := make([]*ledgerEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key() < entries[j].key()
+	})
+	return entries
+}
+
+// lookup returns the latest entry of resource for exactly the given
+// devices.
+func (l *allocationLedger) lookup(resource string, devices []string) (*ledgerEntry, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	want := deviceSetKey(devices)
+	var found *ledgerEntry
+	for _, e := range l.entries {
+		if e.Resource != resource || deviceSetKey(e.Devices) != want {
+			continue
+		}
+		if found == nil || e.AllocatedAt.After(found.AllocatedAt) {
+			found = e
+		}
+	}
+	return found, found != nil
+}
+
+// usedGPUs returns the UUIDs of the gpus held through resource, or through
+// any resource when it is empty, by the pods in alive. The entries of pods
+// not known yet are resolved through the checkpoint.
+func (l *allocationLedger) usedGPUs(alive map[types.UID]bool, resource string, checkpoint *checkpointCache) map[string]bool {
+	l.Lock()
+	defer l.Unlock()
+
+	used := map[string]bool{}
+	for _, e := range l.entries {
+		if resource != "" && e.Resource != resource {
+			continue
+		}
+		uid := e.PodUID
+		if uid == "" {
+			owner, _, ok := e.owner(checkpoint)
+			if !ok {
+				// It may still be in use.
+				for _, uuid := range e.GPUs {
+					used[uuid] = true
+				}
+				continue
+			}
+			uid = owner
+		}
+		if !alive[uid] {
+			continue
+		}
+		for _, uuid := range e.GPUs {
+			used[uuid] = true
+		}
+	}
+	return used
+}
+
+// merge swaps the entries for the given ones, rebuilt from a snapshot of the
+// node taken at since, and saves the ledger. Entries recorded after since are
+// kept, the snapshot can't know them.
+func (l *allocationLedger) merge(entries []*ledgerEntry, since time.Time) error {
+	l.Lock()
+	defer l.Unlock()
+
+	merged := map[string]*ledgerEntry{}
+	for _, e := range entries {
+		merged[e.key()] = e
+	}
+	for key, e := range l.entries {
+		if e.AllocatedAt.After(since) {
+			merged[key] = e
+			continue
+		}
+		if _, ok := merged[key]; !ok {
+			log.Infof("Dropping ledger entry of %s %v of container %s of pod %s in ns %s, it is gone",
+				e.Resource,
+				e.Devices,
+				e.Container,
+				e.Name,
+				e.Namespace)
+		}
+	}
+	l.entries = merged
+	return l.save()
+}
+
+// save writes the ledger. Must be called with the lock held.
+func (l *allocationLedger) save() error {
+	data, err := json.MarshalIndent(l.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path, data, 0600)
+}
+
+// reconcileLedger rebuilds the ledger from the pods on the node the plugin
+// assigned gpus or gpu memory to and from the containers kubelet checkpointed
+// devices for. Entries of pods which are gone or terminated are dropped, so
+// are the entries of unknown pods kubelet has no devices for any more. It
+// runs periodically, see reconcileLedgerPeriodically.
+func (m *NvidiaDevicePlugin) reconcileLedger(ctx context.Context) error {
+	since := time.Now()
+	pods, err := m.pods.list(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	known := map[string]*ledgerEntry{}
+	unowned := []*ledgerEntry{}
+	for _, e := range m.ledger.list() {
+		if e.PodUID == "" {
+			unowned = append(unowned, e)
+			continue
+		}
+		known[e.key()] = e
+	}
+
+	entries := []*ledgerEntry{}
+	alive := map[types.UID]*v1.Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		alive[pod.UID] = pod
+		for _, e := range known {
+			if e.PodUID == pod.UID {
+				entries = append(entries, e)
+			}
+		}
+		entries = append(entries, m.missingGPUEntries(pod, known)...)
+		entries = append(entries, m.missingMemoryEntries(pod, known)...)
+	}
+
+	for _, e := range unowned {
+		uid, container, ok := e.owner(m.checkpoint)
+		if !ok {
+			// The entry may still be in use.
+			entries = append(entries, e)
+			continue
+		}
+		if pod := alive[uid]; pod != nil {
+			owned := *e
+			owned.PodUID, owned.Namespace, owned.Name, owned.Container = pod.UID, pod.Namespace, pod.Name, container
+			entries = append(entries, &owned)
+		}
+	}
+
+	log.Infof("Reconciled the allocation ledger, %d containers hold gpus", len(entries))
+	return m.ledger.merge(entries, since)
+}
+
+// missingGPUEntries returns the entries of the containers of pod the plugin
+// assigned gpus to, or kubelet checkpointed gpus for, the ledger doesn't know.
+func (m *NvidiaDevicePlugin) missingGPUEntries(pod *v1.Pod, known map[string]*ledgerEntry) []*ledgerEntry {
+	checkpoint, err := m.checkpoint.read(resourceName)
+	if err != nil {
+		log.V(4).Infof("Reconciling the ledger without the kubelet checkpoint: %v", err)
+		checkpoint = checkpointDevices{}
+	}
+
+	containers := map[string]bool{}
+	if pod.ObjectMeta.Annotations[EnvAssignedFlag] == "true" {
+		if value := pod.ObjectMeta.Annotations[EnvAssignedContainers]; value != "" {
+			for _, name := range strings.Split(value, ",") {
+				containers[name] = true
+			}
+		} else {
+			for _, container := range getGPUContainers(pod) {
+				containers[container.Name] = true
+			}
+		}
+	}
+	for name := range checkpoint[pod.UID] {
+		containers[name] = true
+	}
+	missing := []string{}
+	for name := range containers {
+		e := &ledgerEntry{PodUID: pod.UID, Container: name, Resource: resourceName}
+		if _, ok := known[e.key()]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	assignment, err := getContainerGPUIndexes(pod, m.gpuTopology, m.registry)
+	if err != nil {
+		log.Warningf("Can't tell the gpus of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+		return nil
+	}
+	entries := []*ledgerEntry{}
+	for _, name := range missing {
+		uuids, err := m.registry.UUIDs(assignment[name])
+		if err != nil || len(uuids) == 0 {
+			log.Warningf("Can't tell the gpus of container %s of pod %s in ns %s: %v", name, pod.Name, pod.Namespace, err)
+			continue
+		}
+		entries = append(entries, podLedgerEntry(pod, name, resourceName, checkpoint[pod.UID][name], uuids))
+	}
+	return entries
+}
+
+// missingMemoryEntries returns the entries of the containers of pod the
+// memory plugin served the ledger doesn't know.
+func (m *NvidiaDevicePlugin) missingMemoryEntries(pod *v1.Pod, known map[string]*ledgerEntry) []*ledgerEntry {
+	value := pod.ObjectMeta.Annotations[EnvMemAssignedContainers]
+	if value == "" {
+		return nil
+	}
+	gpu, err := m.registry.resolve(pod.ObjectMeta.Annotations[EnvMemIdx])
+	if err != nil {
+		log.Warningf("Can't tell the shared gpu of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+		return nil
+	}
+	dev, _ := m.registry.ByIndex(gpu)
+	checkpoint, err := m.checkpoint.read(MemoryResourceName)
+	if err != nil {
+		checkpoint = checkpointDevices{}
+	}
+
+	entries := []*ledgerEntry{}
+	for _, name := range strings.Split(value, ",") {
+		e := &ledgerEntry{PodUID: pod.UID, Container: name, Resource: MemoryResourceName}
+		if _, ok := known[e.key()]; ok {
+			continue
+		}
+		entries = append(entries, podLedgerEntry(pod, name, MemoryResourceName, checkpoint[pod.UID][name], []string{dev.UUID}))
+	}
+	return entries
+}
+
+// podLedgerEntry is the entry of a container found on reconciliation, which
+// got its devices when the pod started, or now if it didn't yet.
+func podLedgerEntry(pod *v1.Pod, container, resource string, devices, uuids []string) *ledgerEntry {
+	allocatedAt := time.Now()
+	if pod.Status.StartTime != nil {
+		allocatedAt = pod.Status.StartTime.Time
+	}
+	return &ledgerEntry{
+		PodUID:      pod.UID,
+		Namespace:   pod.Namespace,
+		Name:        pod.Name,
+		Container:   container,
+		Resource:    resource,
+		Devices:     devices,
+		GPUs:        uuids,
+		AllocatedAt: allocatedAt,
+	}
+}
@@ -0,0 +1,132 @@
+package nvidia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestLedgerMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ledgerName)
+
+	pod := func(uid string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: uid, Namespace: "default", UID: types.UID(uid)}}
+	}
+	l := openLedger(path)
+	if err := l.record(pod("gone"), "main", resourceName, []string{"GPU-0"}, []string{"GPU-0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.record(pod("kept"), "main", MemoryResourceName, []string{"GPU-1-0"}, []string{"GPU-1"}); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	// Allocated while the snapshot was being reconciled.
+	if err := l.record(pod("new"), "main", resourceName, []string{"GPU-2"}, []string{"GPU-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.record(nil, "", "aliyun.com/gpu-replica", []string{"GPU-3::0"}, []string{"GPU-3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := []*ledgerEntry{podLedgerEntry(pod("kept"), "main", MemoryResourceName, []string{"GPU-1-0"}, []string{"GPU-1"})}
+	snapshot[0].AllocatedAt = since.Add(-time.Minute)
+	if err := l.merge(snapshot, since); err != nil {
+		t.Fatal(err)
+	}
+
+	alive := map[types.UID]bool{"gone": true, "kept": true, "new": true}
+	// Without the checkpoint the replica entry may still be in use.
+	checkpoint := newCheckpointCache(filepath.Join(dir, kubeletCheckpointName))
+	used := openLedger(path).usedGPUs(alive, "", checkpoint)
+	for uuid, expected := range map[string]bool{"GPU-0": false, "GPU-1": true, "GPU-2": true, "GPU-3": true} {
+		if used[uuid] != expected {
+			t.Errorf("expected %s used %v, got %v", uuid, expected, used[uuid])
+		}
+	}
+	whole := openLedger(path).usedGPUs(alive, resourceName, checkpoint)
+	for uuid, expected := range map[string]bool{"GPU-0": false, "GPU-1": false, "GPU-2": true, "GPU-3": false} {
+		if whole[uuid] != expected {
+			t.Errorf("expected %s held whole %v, got %v", uuid, expected, whole[uuid])
+		}
+	}
+}
+
+func TestLedgerUsedGPUsOfDeletedPod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, kubeletCheckpointName)
+	checkpoint := newCheckpointCache(path)
+
+	l := openLedger(filepath.Join(dir, ledgerName))
+	// The replica and MIG plugins don't know the pod.
+	if err := l.record(nil, "", "aliyun.com/gpu-replica", []string{"GPU-0::0"}, []string{"GPU-0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.record(nil, "", "aliyun.com/gpu-replica", []string{"GPU-1::0"}, []string{"GPU-1"}); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"Data":{"PodDeviceEntries":[{"PodUID":"a","ContainerName":"main","ResourceName":"aliyun.com/gpu-replica","DeviceIDs":["GPU-0::0"]}]}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// kubelet didn't checkpoint GPU-1::0 yet.
+	used := l.usedGPUs(map[types.UID]bool{"a": true}, "", checkpoint)
+	if !used["GPU-0"] || !used["GPU-1"] {
+		t.Errorf("expected GPU-0 and GPU-1 used, got %v", used)
+	}
+
+	// Pod a is deleted and GPU-1::0 went unclaimed for too long.
+	for _, e := range l.entries {
+		e.AllocatedAt = e.AllocatedAt.Add(-ledgerOwnerGrace)
+	}
+	if used := l.usedGPUs(map[types.UID]bool{}, "", checkpoint); len(used) != 0 {
+		t.Errorf("expected the gpus usable again, got %v", used)
+	}
+}
+
+func TestLedgerLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := openLedger(filepath.Join(dir, ledgerName))
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "old"}}
+	if err := l.record(pod, "main", resourceName, []string{"GPU-0", "GPU-1"}, []string{"GPU-2", "GPU-3"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	// The same devices handed to a later pod.
+	pod = &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Namespace: "default", UID: "new"}}
+	if err := l.record(pod, "main", resourceName, []string{"GPU-1", "GPU-0"}, []string{"GPU-4", "GPU-5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, ok := l.lookup(resourceName, []string{"GPU-0", "GPU-1"})
+	if !ok || e.PodUID != "new" {
+		t.Errorf("expected the entry of pod new, got %+v", e)
+	}
+	if _, ok := l.lookup(MemoryResourceName, []string{"GPU-0", "GPU-1"}); ok {
+		t.Errorf("expected no entry of %s", MemoryResourceName)
+	}
+	if _, ok := l.lookup(resourceName, []string{"GPU-0"}); ok {
+		t.Errorf("expected no entry for GPU-0 alone")
+	}
+}
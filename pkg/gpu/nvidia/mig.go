@@ -0,0 +1,243 @@
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	migSockPrefix = "gputopology-mig-"
+	// envCUDAVisibleDevices restricts CUDA to the MIG instances of a
+	// container, which sees their whole parent gpus.
+	envCUDAVisibleDevices = "CUDA_VISIBLE_DEVICES"
+)
+
+// MIGDevicePlugin advertises MIG instances: the instances of one profile as
+// aliyun.com/mig-<profile> with the mixed strategy, or every instance in
+// place of the gpus with the single strategy. Instances report the NUMA node
+// and health of their parent gpu.
+type MIGDevicePlugin struct {
+	*subPlugin
+	gpu    *NvidiaDevicePlugin
+	migs   []*MIGDevice
+	byUUID map[string]*MIGDevice
+}
+
+func newMIGDevicePlugin(gpu *NvidiaDevicePlugin, migs []*MIGDevice) *MIGDevicePlugin {
+	p := &MIGDevicePlugin{
+		gpu:    gpu,
+		migs:   migs,
+		byUUID: map[string]*MIGDevice{},
+	}
+	for _, mig := range migs {
+		p.byUUID[mig.UUID] = mig
+	}
+	return p
+}
+
+// setupMIG discovers the MIG instances and serves them according to the MIG
+// strategy.
+func (m *NvidiaDevicePlugin) setupMIG() error {
+	if m.opts.MIGStrategy == NoneMIGStrategy {
+		return nil
+	}
+
+	profiles := map[string][]*MIGDevice{}
+	for _, d := range m.registry.Devices() {
+		migs, err := m.backend.MIGDevices(d)
+		if err != nil {
+			return fmt.Errorf("failed to discover the mig instances of gpu %d: %v", d.Index, err)
+		}
+		for _, mig := range migs {
+			profiles[mig.Profile] = append(profiles[mig.Profile], mig)
+			m.migParents[int(d.Index)] = true
+		}
+		if len(migs) > 0 {
+			log.Infof("GPU %d has %d MIG instances", d.Index, len(migs))
+		}
+	}
+	if len(profiles) == 0 {
+		log.Infof("No MIG instance found, serving whole GPUs")
+		return nil
+	}
+	if (m.opts.CDIAllocation || m.opts.PassDeviceSpecs) && len(m.driver.migCapDevices) == 0 {
+		return fmt.Errorf("no MIG capability device found under %s, needed to pass the MIG instances as devices", m.opts.ContainerDriverRoot)
+	}
+
+	switch m.opts.MIGStrategy {
+	case SingleMIGStrategy:
+		if len(profiles) > 1 {
+			return fmt.Errorf("the %s mig strategy needs a single profile, found %d", SingleMIGStrategy, len(profiles))
+		}
+		if len(m.migParents) != m.registry.Len() {
+			return fmt.Errorf("the %s mig strategy needs mig on every gpu, %d of %d have it", SingleMIGStrategy, len(m.migParents), m.registry.Len())
+		}
+		for _, migs := range profiles {
+			m.inPlace = newMIGDevicePlugin(m, migs)
+			m.migs = migs
+		}
+	case MixedMIGStrategy:
+		names := []string{}
+		for profile := range profiles {
+			names = append(names, profile)
+		}
+		sort.Strings(names)
+		for _, profile := range names {
+			p := newMIGDevicePlugin(m, profiles[profile])
+			p.subPlugin = newSubPlugin(m.opts.migSocket(profile), MIGResourcePrefix+profile)
+			m.plugins = append(m.plugins, p)
+			m.migs = append(m.migs, profiles[profile]...)
+		}
+	}
+	return nil
+}
+
+// devices lists the MIG instances, which are as healthy as their parent.
+func (p *MIGDevicePlugin) devices() []*pluginapi.Device {
+	p.gpu.RLock()
+	defer p.gpu.RUnlock()
+
+	devs := []*pluginapi.Device{}
+	for _, mig := range p.migs {
+		parent := p.gpu.devs[mig.Parent.Index]
+		devs = append(devs, &pluginapi.Device{
+			ID:       mig.UUID,
+			Health:   parent.Health,
+			Topology: parent.Topology,
+		})
+	}
+	return devs
+}
+
+// resource is the resource the MIG instances are advertised as.
+func (p *MIGDevicePlugin) resource() string {
+	if p.subPlugin == nil {
+		return resourceName
+	}
+	return p.resourceName
+}
+
+// parents returns the gpus the MIG instances with the given ids belong to.
+func (p *MIGDevicePlugin) parents(ids []string) ([]int, error) {
+	gpus := []int{}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		mig, ok := p.byUUID[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown device %s", id)
+		}
+		if gpu := int(mig.Parent.Index); !seen[gpu] {
+			seen[gpu] = true
+			gpus = append(gpus, gpu)
+		}
+	}
+	return gpus, nil
+}
+
+func (p *MIGDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                p.gpu.opts.PreStartRequired,
+		GetPreferredAllocationAvailable: true,
+	}, nil
+}
+
+// ListAndWatch lists the MIG instances and sends them again whenever the
+// health of a gpu changes.
+func (p *MIGDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return p.listAndWatch(s)
+}
+
+// Allocate hands the MIG instances to the containers the way whole gpus are
+// handed out: by UUID to the nvidia runtime, which then adds the driver files
+// and the MIG capability device nodes, as CDI devices, or as device specs.
+func (p *MIGDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		gpus, err := p.parents(req.DevicesIDs)
+		if err != nil {
+			p.gpu.recorder.Eventf(p.gpu.recorder.nodeRef(), v1.EventTypeWarning, reasonUnknownGPU,
+				"Kubelet requested unknown MIG instances %s", strings.Join(req.DevicesIDs, ","))
+			return p.gpu.failAllocation(reqs, err)
+		}
+		response := p.containerResponse(req.DevicesIDs)
+		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		log.Infof("Assigned MIG instances %v of GPUs %s to a container", req.DevicesIDs, formatGPUIndexes(gpus))
+		if err := p.gpu.ledger.record(nil, "", p.resource(), req.DevicesIDs, req.DevicesIDs); err != nil {
+			log.Warningf("Failed to record the MIG instances %v: %v", req.DevicesIDs, err)
+		}
+	}
+	return &responses, nil
+}
+
+// containerResponse is NvidiaDevicePlugin.containerResponse for the MIG
+// instances with the given ids. Their device specs are the gpus they are
+// carved out of and the MIG capability devices, CUDA is restricted to them.
+func (p *MIGDevicePlugin) containerResponse(ids []string) pluginapi.ContainerAllocateResponse {
+	response := pluginapi.ContainerAllocateResponse{
+		Envs: map[string]string{
+			EnvNVGPU: strings.Join(ids, ","),
+		},
+	}
+	switch {
+	case p.gpu.opts.CDIAllocation:
+		response.Envs = map[string]string{}
+		response.Annotations = map[string]string{
+			cdiAnnotation: cdiDeviceNames(ids),
+		}
+	case p.gpu.opts.PassDeviceSpecs:
+		var parents []*GPUDevice
+		for _, id := range ids {
+			parents = append(parents, p.byUUID[id].Parent)
+		}
+		response.Envs[envCUDAVisibleDevices] = strings.Join(ids, ",")
+		response.Devices = p.gpu.driver.migDeviceSpecs(parents)
+		response.Mounts = p.gpu.driver.mounts()
+	}
+	return response
+}
+
+// GetPreferredAllocation keeps the instances of a container on a single gpu,
+// the fullest one they fit on.
+func (p *MIGDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	responses := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		response := &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: preferSingleGPU(req, func(id string) (int, bool) {
+				mig, ok := p.byUUID[id]
+				if !ok {
+					return 0, false
+				}
+				return int(mig.Parent.Index), true
+			}),
+		}
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	return responses, nil
+}
+
+// PreStartContainer refuses to start containers on the instances of gpus
+// which are unhealthy or under maintenance.
+func (p *MIGDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if !p.gpu.opts.PreStartRequired {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	gpus, err := p.parents(req.DevicesIDs)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "gpus not ready: %v", err)
+	}
+	return p.gpu.preStartShared(ctx, req.DevicesIDs, gpus)
+}
+
+// Serve starts the gRPC server and registers the MIG resource with Kubelet.
+func (p *MIGDevicePlugin) Serve() error {
+	return p.serve(p, p.gpu.opts.kubeletSocket())
+}
@@ -0,0 +1,105 @@
+package nvidia
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestMIGContainerResponse(t *testing.T) {
+	gpu0 := &GPUDevice{Index: 0, UUID: "GPU-0", Path: "/dev/nvidia0"}
+	migs := []*MIGDevice{
+		{Parent: gpu0, Index: 0, UUID: "MIG-0", Profile: "1g.5gb"},
+		{Parent: gpu0, Index: 1, UUID: "MIG-1", Profile: "1g.5gb"},
+	}
+	driver := &driverFiles{
+		hostRoot:       "/host",
+		controlDevices: []string{"/dev/nvidiactl"},
+		migCapDevices:  []string{"/dev/nvidia-caps/nvidia-cap1"},
+		files:          []string{"/usr/bin/nvidia-smi"},
+	}
+
+	p := newMIGDevicePlugin(&NvidiaDevicePlugin{opts: &Options{}, driver: driver}, migs)
+	response := p.containerResponse([]string{"MIG-0", "MIG-1"})
+	if visible := response.Envs[EnvNVGPU]; visible != "MIG-0,MIG-1" {
+		t.Errorf("expected the instances to be visible, got %q", visible)
+	}
+	if len(response.Devices) != 0 {
+		t.Errorf("expected no device specs without PassDeviceSpecs, got %v", response.Devices)
+	}
+
+	p.gpu.opts = &Options{CDIAllocation: true}
+	response = p.containerResponse([]string{"MIG-1"})
+	if devices := response.Annotations[cdiAnnotation]; devices != cdiKind+"=MIG-1" {
+		t.Errorf("expected the instance as CDI device, got %q", devices)
+	}
+	if len(response.Envs) != 0 {
+		t.Errorf("expected no env with CDI, got %v", response.Envs)
+	}
+
+	p.gpu.opts = &Options{PassDeviceSpecs: true}
+	response = p.containerResponse([]string{"MIG-0", "MIG-1"})
+	if visible := response.Envs[envCUDAVisibleDevices]; visible != "MIG-0,MIG-1" {
+		t.Errorf("expected CUDA restricted to the instances, got %q", visible)
+	}
+	paths := map[string]string{}
+	for _, spec := range response.Devices {
+		paths[spec.ContainerPath] = spec.HostPath + " " + spec.Permissions
+	}
+	expected := map[string]string{
+		"/dev/nvidia0":                 "/host/dev/nvidia0 rw",
+		"/dev/nvidiactl":               "/host/dev/nvidiactl rw",
+		"/dev/nvidia-caps/nvidia-cap1": "/host/dev/nvidia-caps/nvidia-cap1 r",
+	}
+	if !reflect.DeepEqual(paths, expected) || len(response.Devices) != len(expected) {
+		t.Errorf("expected device specs %v, got %v", expected, paths)
+	}
+	if len(response.Mounts) != 1 {
+		t.Errorf("expected the driver files mounted, got %v", response.Mounts)
+	}
+}
+
+func TestMIGParentsLeftOut(t *testing.T) {
+	fixture := &FakeFixture{GPUs: []FakeGPU{
+		{UUID: "GPU-0", Memory: 4096},
+		{UUID: "GPU-1", Memory: 4096},
+	}}
+	backend, err := NewFakeBackend(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := newDeviceRegistry(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpu := &NvidiaDevicePlugin{
+		devs:       registry.pluginDevices(),
+		registry:   registry,
+		opts:       &Options{MemoryUnit: GiBMemoryUnit, Replicas: "2", ReplicaResourceName: "aliyun.com/gpu-replica"},
+		migParents: map[int]bool{0: true},
+	}
+
+	replicas, err := newReplicaDevicePlugin(gpu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory, err := newMemoryDevicePlugin(gpu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, devs := range map[string][]*pluginapi.Device{"replica": replicas.devices(), "memory": memory.devices()} {
+		if len(devs) == 0 {
+			t.Errorf("expected %s devices of gpu 1", name)
+		}
+		for _, d := range devs {
+			if strings.HasPrefix(d.ID, "GPU-0") {
+				t.Errorf("expected no %s device of the MIG parent, got %s", name, d.ID)
+			}
+		}
+	}
+	if _, err := replicas.replicaGPU(replicaID("GPU-0", 0)); err == nil {
+		t.Errorf("expected a replica of the MIG parent to be refused")
+	}
+}
@@ -0,0 +1,58 @@
+package nvidia
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const nodeCacheResync = 5 * time.Minute
+
+// nodeCache is an informer backed view of the node of the plugin, so
+// container starts don't get the node from the API server each time.
+type nodeCache struct {
+	kube     *KubeClient
+	informer cache.SharedIndexInformer
+	lister   listerv1.NodeLister
+}
+
+func newNodeCache(kube *KubeClient) *nodeCache {
+	informer := coreinformers.NewFilteredNodeInformer(
+		kube.Clientset,
+		nodeCacheResync,
+		cache.Indexers{},
+		func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", kube.NodeName).String()
+		})
+	return &nodeCache{
+		kube:     kube,
+		informer: informer,
+		lister:   listerv1.NewNodeLister(informer.GetIndexer()),
+	}
+}
+
+// run fills and updates the cache until stop is closed.
+func (c *nodeCache) run(stop <-chan struct{}) {
+	log.Infof("Starting the node cache of node %s", c.kube.NodeName)
+	c.informer.Run(stop)
+}
+
+// get returns the cached node. It waits for the cache to sync first.
+func (c *nodeCache) get(ctx context.Context) (*v1.Node, error) {
+	if !c.informer.HasSynced() {
+		ctx, cancel := context.WithTimeout(ctx, podCacheSyncTimeout)
+		defer cancel()
+		if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+			return nil, fmt.Errorf("node cache of node %s not synced: %v", c.kube.NodeName, ctx.Err())
+		}
+	}
+	return c.lister.Get(c.kube.NodeName)
+}
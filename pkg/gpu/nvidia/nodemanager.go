@@ -1,11 +1,12 @@
 package nvidia
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"encoding/json"
+	"time"
 
 	log "github.com/golang/glog"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -14,16 +15,27 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-var (
-	clientset *kubernetes.Clientset
-	nodeName  string
-)
+const nodeTypeTimeout = 5 * time.Second
+
+// KubeClient carries the API client and the node the plugin is running on.
+type KubeClient struct {
+	Clientset kubernetes.Interface
+	NodeName  string
+	// Config is nil when the client was not built from a rest config, e.g. a fake clientset.
+	Config *rest.Config
+}
 
-func init() {
-	kubeInit()
+// NewKubeClient wraps an existing clientset, such as client-go's fake one.
+func NewKubeClient(clientset kubernetes.Interface, nodeName string) *KubeClient {
+	return &KubeClient{
+		Clientset: clientset,
+		NodeName:  nodeName,
+	}
 }
 
-func kubeInit() {
+// NewKubeClientFromEnv builds the client from KUBECONFIG, falling back to the
+// in-cluster config, and reads the node name from NODE_NAME.
+func NewKubeClientFromEnv() (*KubeClient, error) {
 	kubeconfigFile := os.Getenv("KUBECONFIG")
 	var err error
 	var config *rest.Config
@@ -32,28 +44,34 @@ func kubeInit() {
 		log.V(5).Infof("kubeconfig %s failed to find due to %v", kubeconfigFile, err)
 		config, err = rest.InClusterConfig()
 		if err != nil {
-			log.Fatalf("Failed due to %v", err)
+			return nil, err
 		}
 	} else {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigFile)
 		if err != nil {
-			log.Fatalf("Failed due to %v", err)
+			return nil, err
 		}
 	}
 
-	clientset, err = kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Fatalf("Failed due to %v", err)
+		return nil, err
 	}
 
-	nodeName = os.Getenv("NODE_NAME")
+	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
-		log.Fatalln("Please set env NODE_NAME")
+		return nil, fmt.Errorf("please set env NODE_NAME")
 	}
+
+	return &KubeClient{
+		Clientset: clientset,
+		NodeName:  nodeName,
+		Config:    config,
+	}, nil
 }
 
-func patchGPUTopology(topology gpuTopology) error {
-	node, err := clientset.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+func patchGPUTopology(kube *KubeClient, topology gpuTopology) error {
+	node, err := kube.Clientset.CoreV1().Nodes().Get(kube.NodeName, metav1.GetOptions{})
 
 	if err != nil {
 		return err
@@ -75,16 +93,19 @@ func patchGPUTopology(topology gpuTopology) error {
 	}
 
 	envGPUTopologyJson, err := json.Marshal(envGPUTopologyMap)
-	
+
 	if err != nil {
 		log.Infof("invalid gpu topology map %v", envGPUTopologyMap)
 		return err
 	}
 
 	log.Infof("gpu topology json %v", string(envGPUTopologyJson))
+	if newNode.ObjectMeta.Annotations == nil {
+		newNode.ObjectMeta.Annotations = map[string]string{}
+	}
 	newNode.ObjectMeta.Annotations[EnvAnnotationKey] = string(envGPUTopologyJson)
 
-	_, err = clientset.CoreV1().Nodes().Update(newNode)
+	_, err = kube.Clientset.CoreV1().Nodes().Update(newNode)
 	if err != nil {
 		log.Infof("Failed to fetch node gpu annotation %s.", topology)
 	} else {
@@ -94,11 +115,11 @@ func patchGPUTopology(topology gpuTopology) error {
 	return err
 }
 
-func patchNodeType() error {
-	
+func patchNodeType(kube *KubeClient, url string) error {
+
 	// get note tpye
-	url := "http://100.100.100.200/latest/meta-data/instance/instance-type"
-	resp, err := http.Get(url)
+	client := http.Client{Timeout: nodeTypeTimeout}
+	resp, err := client.Get(url)
 	if err != nil {
 		return err
 	}
@@ -108,23 +129,26 @@ func patchNodeType() error {
 		return err
 	}
 	nodeType := string(body)
-	
+
 	log.Infof("fetch node type %v", nodeType)
-	
+
 	// update node type
-	node, err := clientset.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	node, err := kube.Clientset.CoreV1().Nodes().Get(kube.NodeName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
-	
+
 	newNode := node.DeepCopy()
+	if newNode.ObjectMeta.Annotations == nil {
+		newNode.ObjectMeta.Annotations = map[string]string{}
+	}
 	newNode.ObjectMeta.Annotations[EnvNodeType] = nodeType
-	_, err = clientset.CoreV1().Nodes().Update(newNode)
+	_, err = kube.Clientset.CoreV1().Nodes().Update(newNode)
 	if err != nil {
 		log.Infof("Failed to fetch node type %s.", nodeType)
 	} else {
 		log.Infof("Success in update node type %s.", nodeType)
 	}
-	
+
 	return err
-}
\ No newline at end of file
+}
@@ -0,0 +1,67 @@
+package nvidia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	log "github.com/golang/glog"
+)
+
+// noNUMANode is the NUMA node of gpus whose node is unknown, like sysfs
+// reports it when the firmware does not tell.
+const noNUMANode = -1
+
+// pciDevicesDir lists the PCI devices in sysfs.
+var pciDevicesDir = "/sys/bus/pci/devices"
+
+// pciNUMANode reads the NUMA node of the PCI device with the given bus id,
+// as reported by nvml with an 8 digit domain, e.g. 00000000:3B:00.0.
+func pciNUMANode(busID string) int {
+	id := strings.ToLower(busID)
+	if len(id) > len("0000:00:00.0") {
+		id = id[len(id)-len("0000:00:00.0"):]
+	}
+	data, err := ioutil.ReadFile(filepath.Join(pciDevicesDir, id, "numa_node"))
+	if err != nil {
+		log.V(4).Infof("Can't tell the NUMA node of %s: %v", busID, err)
+		return noNUMANode
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || node < 0 {
+		return noNUMANode
+	}
+	return node
+}
+
+// applyNUMAOverrides sets the NUMA node of the gpus listed in the file at
+// path, which maps gpu indexes or UUIDs to nodes, e.g.
+//
+//	"0": 0
+//	GPU-8f6f6a1e: 1
+func (r *deviceRegistry) applyNUMAOverrides(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	overrides := map[string]int{}
+	if err := yaml.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("invalid NUMA overrides %s: %v", path, err)
+	}
+	for id, node := range overrides {
+		gpu, err := r.resolve(id)
+		if err != nil {
+			return fmt.Errorf("invalid NUMA overrides %s: %v", path, err)
+		}
+		if node < 0 {
+			node = noNUMANode
+		}
+		d := r.devices[gpu]
+		log.Infof("Overriding the NUMA node of gpu %d from %d to %d", gpu, d.NUMANode, node)
+		d.NUMANode = node
+	}
+	return nil
+}
@@ -6,11 +6,12 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 
 	"golang.org/x/net/context"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func check(err error) {
@@ -19,56 +20,31 @@ func check(err error) {
 	}
 }
 
-func getDevices() []*pluginapi.Device {
-	n, err := nvml.GetDeviceCount()
-	check(err)
-
-	var devs []*pluginapi.Device
-	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDeviceLite(i)
-		check(err)
-		devs = append(devs, &pluginapi.Device{
-			ID:     d.UUID,
-			Health: pluginapi.Healthy,
-		})
-	}
-
-	return devs
-}
+func getGpuTopology(backend Backend, registry *deviceRegistry) gpuTopology {
+	devs := registry.Devices()
+	n := len(devs)
 
-func getGpuTopology() gpuTopology {
-	n, err := nvml.GetDeviceCount()
-	check(err)
-	
 	// init gpuTopology
 	topology := make([][]gpuTopologyType, n)
-	for i := 0; i < int(n); i++ {
+	for i := 0; i < n; i++ {
 		topology[i] = make([]gpuTopologyType, n)
 	}
-	
-	var devs []*nvml.Device
 
-	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDeviceLite(i)
-		check(err)
-		devs = append(devs, d)
-	}
-
-	for i := 0; i < int(n); i++ {
-		for j := 0; j < int(n); j++ {
-			if (i < j) {
-				p2plink, err := nvml.GetP2PLink(devs[i], devs[j])
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i < j {
+				p2plink, err := backend.P2PLink(devs[i], devs[j])
 				check(err)
-				if p2plink != nvml.P2PLinkUnknown {
-					topology[i][j] = gpuTopologyType(p2plink)
+				if p2plink != gpuTopologyType(nvml.P2PLinkUnknown) {
+					topology[i][j] = p2plink
 				}
-				nvlink, err := nvml.GetNVLink(devs[i], devs[j])
+				nvlink, err := backend.NVLink(devs[i], devs[j])
 				check(err)
-				if nvlink != nvml.P2PLinkUnknown {
-					topology[i][j] = gpuTopologyType(nvlink)
+				if nvlink != gpuTopologyType(nvml.P2PLinkUnknown) {
+					topology[i][j] = nvlink
 				}
-				
-				log.Printf("Warning: gpu%v == gpu%v topogoloy is: %v, description is %v, origin value %v", i, j, gpuTopologyType(topology[i][j]).Abbreviation(), gpuTopologyType(topology[i][j]).String(), gpuTopologyType(topology[i][j]))
+
+				log.Printf("Warning: gpu%v == gpu%v topogoloy is: %v, description is %v, origin value %v", i, j, topology[i][j].Abbreviation(), topology[i][j].String(), topology[i][j])
 			}
 		}
 	}
@@ -76,22 +52,6 @@ func getGpuTopology() gpuTopology {
 	return topology
 }
 
-func getDevNameMap() map[string]uint {
-	n, err := nvml.GetDeviceCount()
-	check(err)
-	realDevNameMap := map[string]uint{}
-
-	for i := uint(0); i < n; i++ {
-		d, err := nvml.NewDevice(i)
-		check(err)
-		var id uint
-		_, err = fmt.Sscanf(d.Path, "/dev/nvidia%d", &id)
-		check(err)
-		realDevNameMap[d.UUID] = id
-	}
-	return realDevNameMap
-}
-
 func deviceExists(devs []*pluginapi.Device, id string) bool {
 	for _, d := range devs {
 		if d.ID == id {
@@ -101,16 +61,35 @@ func deviceExists(devs []*pluginapi.Device, id string) bool {
 	return false
 }
 
-func watchXIDs(ctx context.Context, devs []*pluginapi.Device, xids chan<- *pluginapi.Device) {
-	eventSet := nvml.NewEventSet()
-	defer nvml.DeleteEventSet(eventSet)
+func watchXIDs(ctx context.Context, backend Backend, registry *deviceRegistry, devs []*pluginapi.Device, policy *xidPolicy, xids chan<- healthEvent) {
+	eventSet, err := backend.NewEventSet()
+	if err != nil {
+		log.Panicln("Fatal:", err)
+	}
+	defer eventSet.Close()
+
+	// send reports whether e was sent before the watch was stopped.
+	send := func(e healthEvent) bool {
+		select {
+		case xids <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
 	for _, d := range devs {
-		err := nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, d.ID)
+		gpu, ok := registry.ByUUID(d.ID)
+		if !ok {
+			log.Panicln("Fatal: unknown device", d.ID)
+		}
+		err := eventSet.RegisterXIDs(gpu)
 		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
 			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", d.ID, err)
 
-			xids <- d
+			if !send(healthEvent{dev: d, reason: "health checking not supported", permanent: true}) {
+				return
+			}
 			continue
 		}
 
@@ -126,29 +105,37 @@ func watchXIDs(ctx context.Context, devs []*pluginapi.Device, xids chan<- *plugi
 		default:
 		}
 
-		e, err := nvml.WaitForEvent(eventSet, 5000)
-		if err != nil && e.Etype != nvml.XidCriticalError {
+		e, err := eventSet.Wait(5 * time.Second)
+		if err != nil || e == nil {
 			continue
 		}
 
-		// FIXME: formalize the full list and document it.
-		// http://docs.nvidia.com/deploy/xid-errors/index.html#topic_4
-		// Application errors: the GPU should still be healthy
-		if e.Edata == 31 || e.Edata == 43 || e.Edata == 45 {
+		action := policy.action(e.Xid)
+		if action == ignoreXID {
+			log.Printf("Ignoring XID %d on %s, an application error", e.Xid, e.UUID)
 			continue
 		}
 
-		if e.UUID == nil || len(*e.UUID) == 0 {
+		reason := fmt.Sprintf("XID %d", e.Xid)
+		if action == rebootXID {
+			reason = fmt.Sprintf("XID %d, needs a reboot", e.Xid)
+		}
+		if len(e.UUID) == 0 || action == nodeXID {
 			// All devices are unhealthy
+			if len(e.UUID) != 0 {
+				reason = fmt.Sprintf("XID %d on %s", e.Xid, e.UUID)
+			}
 			for _, d := range devs {
-				xids <- d
+				if !send(healthEvent{dev: d, reason: reason, untilReboot: action == rebootXID}) {
+					return
+				}
 			}
 			continue
 		}
 
 		for _, d := range devs {
-			if d.ID == *e.UUID {
-				xids <- d
+			if d.ID == e.UUID && !send(healthEvent{dev: d, reason: reason, untilReboot: action == rebootXID}) {
+				return
 			}
 		}
 	}
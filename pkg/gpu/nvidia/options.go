@@ -0,0 +1,305 @@
+package nvidia
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	defaultNodeTypeURL = "http://100.100.100.200/latest/meta-data/instance/instance-type"
+
+	envAllocationMode      = "DP_ALLOCATION_MODE"
+	envPassDeviceSpecs     = "DP_PASS_DEVICE_SPECS"
+	envDriverRoot          = "DP_DRIVER_ROOT"
+	envContainerDriverRoot = "DP_CONTAINER_DRIVER_ROOT"
+	envCDISpecDir          = "DP_CDI_SPEC_DIR"
+	envCDIAllocation       = "DP_CDI_ALLOCATION"
+	envKubeletCheckpoint   = "DP_KUBELET_CHECKPOINT"
+	envAssumeTimeout       = "DP_ASSUME_TIMEOUT"
+	envFailurePolicy       = "DP_FAILURE_POLICY"
+	envPreStartRequired    = "DP_PRE_START_REQUIRED"
+	envNUMAOverrides       = "DP_NUMA_OVERRIDES"
+	envMemoryUnit          = "DP_MEMORY_UNIT"
+	envReplicas            = "DP_REPLICAS"
+	envReplicaResourceName = "DP_REPLICA_RESOURCE_NAME"
+	envMIGStrategy         = "DP_MIG_STRATEGY"
+	envHealthRecovery      = "DP_HEALTH_RECOVERY_PERIOD"
+	envHealthProbe         = "DP_HEALTH_PROBE"
+	envHealthFlapWindow    = "DP_HEALTH_FLAP_WINDOW"
+	envHealthFlapThreshold = "DP_HEALTH_FLAP_THRESHOLD"
+	envHealthChecksConfig  = "DP_HEALTH_CHECKS_CONFIG"
+	envXIDPolicy           = "DP_XID_POLICY"
+	envRebootMarks         = "DP_REBOOT_MARKS"
+
+	defaultAssumeTimeout       = 10 * time.Minute
+	defaultHealthFlapWindow    = 10 * time.Minute
+	defaultHealthFlapThreshold = 3
+	defaultRebootMarks         = "/var/lib/gputopology/unhealthy-until-reboot.json"
+
+	// SchedulerAllocationMode only hands out the gpus chosen by the scheduler
+	// extender in the pod annotations.
+	SchedulerAllocationMode = "scheduler"
+	// TopologyAllocationMode lets the plugin pick the best connected free gpus
+	// itself when the pod was not annotated by the scheduler extender.
+	TopologyAllocationMode = "topology"
+
+	// LegacyFailurePolicy starts the containers kubelet can't get gpus for
+	// with ALIYUN_COM_GPU_GROUP=-1.
+	LegacyFailurePolicy = "legacy"
+	// FailClosedPolicy fails the allocation, so kubelet refuses to start the
+	// pod with an admission error.
+	FailClosedPolicy = "fail-closed"
+	// RestrictedFailurePolicy starts the containers kubelet can't get gpus for
+	// without any gpu, with NVIDIA_VISIBLE_DEVICES=none.
+	RestrictedFailurePolicy = "restricted"
+
+	// GiBMemoryUnit and MiBMemoryUnit are the sizes of the gpu memory
+	// shares.
+	GiBMemoryUnit = "GiB"
+	MiBMemoryUnit = "MiB"
+
+	// NoneMIGStrategy ignores MIG, gpus are handed out whole.
+	NoneMIGStrategy = "none"
+	// SingleMIGStrategy advertises the MIG instances as aliyun.com/gpu in
+	// place of the gpus, which must all be split with the same profile.
+	SingleMIGStrategy = "single"
+	// MixedMIGStrategy advertises the MIG instances of every profile as a
+	// resource of their own, e.g. aliyun.com/mig-1g.5gb, next to the gpus
+	// without MIG.
+	MixedMIGStrategy = "mixed"
+)
+
+// Options tune the device plugin. Start from NewOptionsFromEnv and override
+// what is needed, e.g. point DevicePluginPath to a temp dir in tests.
+type Options struct {
+	// DevicePluginPath is the directory holding kubelet.sock and the plugin socket.
+	DevicePluginPath string
+	// NodeTypeURL is the instance metadata endpoint returning the node type.
+	NodeTypeURL string
+	// AllocationMode is SchedulerAllocationMode or TopologyAllocationMode.
+	AllocationMode string
+	// PassDeviceSpecs adds the gpu device nodes and the driver files to the
+	// allocation responses, so containers get gpus without the nvidia runtime.
+	PassDeviceSpecs bool
+	// DriverRoot is the root of the driver installation on the host.
+	DriverRoot string
+	// ContainerDriverRoot is where the plugin sees DriverRoot, e.g. the host
+	// mount of the plugin container or a fake tree in tests.
+	ContainerDriverRoot string
+	// CDISpecDir, e.g. /etc/cdi, receives a CDI spec describing every gpu
+	// when set.
+	CDISpecDir string
+	// CDIAllocation hands the gpus to the runtime as CDI devices instead of
+	// NVIDIA_VISIBLE_DEVICES. It needs CDISpecDir.
+	CDIAllocation bool
+	// KubeletCheckpoint is the device manager checkpoint of kubelet, which
+	// tells the pods kubelet asks for again after a restart and the pods
+	// holding gpus already. It defaults to kubelet_internal_checkpoint in
+	// DevicePluginPath.
+	KubeletCheckpoint string
+	// AssumeTimeout is how long a pod assumed by the scheduler extender may
+	// wait for its allocation before its assumption is cleared. Zero keeps
+	// assumptions forever.
+	AssumeTimeout time.Duration
+	// FailurePolicy is LegacyFailurePolicy, FailClosedPolicy or
+	// RestrictedFailurePolicy. It applies to every failed allocation: no
+	// pod found, an assignment that doesn't match the request or can't be
+	// recorded, and requests for gpus the plugin doesn't know.
+	FailurePolicy string
+	// PreStartRequired makes kubelet call PreStartContainer, which refuses
+	// to start containers on gpus which are unhealthy, still run processes
+	// or are under maintenance.
+	PreStartRequired bool
+	// NUMAOverrides is a file mapping gpu indexes or UUIDs to the NUMA node
+	// to advertise, for machines whose firmware reports none.
+	NUMAOverrides string
+	// MemoryUnit, GiBMemoryUnit or MiBMemoryUnit, enables sharing gpus by
+	// memory: every gpu is also advertised as one aliyun.com/gpu-mem device
+	// per unit of its memory. The plugin refuses to start when the devices
+	// are too many for kubelet to receive, MiB fits about 60GB of gpus.
+	MemoryUnit string
+	// Replicas, e.g. "4" or "4,0=2,GPU-8a9c...=8", time-slices every gpu
+	// into replica devices: a default count optionally followed by counts
+	// for single gpus by index or UUID.
+	Replicas string
+	// ReplicaResourceName is the resource the replicas are advertised as. It
+	// defaults to aliyun.com/gpu, which then no longer hands out whole gpus.
+	ReplicaResourceName string
+	// MIGStrategy is NoneMIGStrategy, SingleMIGStrategy or MixedMIGStrategy.
+	MIGStrategy string
+	// HealthRecoveryPeriod is how long an unhealthy gpu must stay quiet
+	// before it is advertised healthy again. Zero keeps it unhealthy until
+	// the plugin restarts.
+	HealthRecoveryPeriod time.Duration
+	// HealthProbe also requires a recovering gpu to answer the driver.
+	HealthProbe bool
+	// HealthFlapWindow and HealthFlapThreshold damp flapping gpus: every
+	// problem beyond the threshold within the window doubles the recovery
+	// period.
+	HealthFlapWindow    time.Duration
+	HealthFlapThreshold int
+	// HealthChecksConfig is a file setting the interval and thresholds of
+	// the health checks beyond xids: ecc, temperature, throttle and power.
+	HealthChecksConfig string
+	// XIDPolicy is a file mapping XIDs to what they do to the gpus, on top
+	// of the default table. It is reloaded whenever it changes.
+	XIDPolicy string
+	// RebootMarks is a file on the host keeping the gpus unhealthy until
+	// the node reboots across restarts of the plugin. Empty keeps them in
+	// memory only.
+	RebootMarks string
+}
+
+// NewOptionsFromEnv returns the options of a plugin deployed on a node.
+func NewOptionsFromEnv() *Options {
+	opts := &Options{
+		DevicePluginPath: pluginapi.DevicePluginPath,
+		NodeTypeURL:      defaultNodeTypeURL,
+		AllocationMode:   SchedulerAllocationMode,
+		DriverRoot:       "/",
+		AssumeTimeout:    defaultAssumeTimeout,
+		FailurePolicy:    LegacyFailurePolicy,
+		MIGStrategy:      NoneMIGStrategy,
+
+		HealthProbe:         true,
+		HealthFlapWindow:    defaultHealthFlapWindow,
+		HealthFlapThreshold: defaultHealthFlapThreshold,
+		RebootMarks:         defaultRebootMarks,
+	}
+	if mode := strings.ToLower(os.Getenv(envAllocationMode)); mode != "" {
+		opts.AllocationMode = mode
+	}
+	boolFromEnv(envPassDeviceSpecs, &opts.PassDeviceSpecs)
+	if root := os.Getenv(envDriverRoot); root != "" {
+		opts.DriverRoot = root
+	}
+	opts.ContainerDriverRoot = opts.DriverRoot
+	if root := os.Getenv(envContainerDriverRoot); root != "" {
+		opts.ContainerDriverRoot = root
+	}
+	opts.CDISpecDir = os.Getenv(envCDISpecDir)
+	boolFromEnv(envCDIAllocation, &opts.CDIAllocation)
+	opts.KubeletCheckpoint = os.Getenv(envKubeletCheckpoint)
+	durationFromEnv(envAssumeTimeout, &opts.AssumeTimeout)
+	if policy := strings.ToLower(os.Getenv(envFailurePolicy)); policy != "" {
+		opts.FailurePolicy = policy
+	}
+	boolFromEnv(envPreStartRequired, &opts.PreStartRequired)
+	opts.NUMAOverrides = os.Getenv(envNUMAOverrides)
+	opts.MemoryUnit = os.Getenv(envMemoryUnit)
+	opts.Replicas = os.Getenv(envReplicas)
+	opts.ReplicaResourceName = os.Getenv(envReplicaResourceName)
+	if strategy := strings.ToLower(os.Getenv(envMIGStrategy)); strategy != "" {
+		opts.MIGStrategy = strategy
+	}
+	durationFromEnv(envHealthRecovery, &opts.HealthRecoveryPeriod)
+	boolFromEnv(envHealthProbe, &opts.HealthProbe)
+	durationFromEnv(envHealthFlapWindow, &opts.HealthFlapWindow)
+	intFromEnv(envHealthFlapThreshold, &opts.HealthFlapThreshold)
+	opts.HealthChecksConfig = os.Getenv(envHealthChecksConfig)
+	opts.XIDPolicy = os.Getenv(envXIDPolicy)
+	if marks, ok := os.LookupEnv(envRebootMarks); ok {
+		opts.RebootMarks = marks
+	}
+	return opts
+}
+
+// boolFromEnv sets value from the env variable name when it is set. A
+// malformed value is logged and leaves value as is, so are the ones of
+// durationFromEnv and intFromEnv.
+func boolFromEnv(name string, value *bool) {
+	if s := os.Getenv(name); s != "" {
+		parsed, err := strconv.ParseBool(s)
+		if err != nil {
+			log.Warningf("Ignoring %s=%q, using %v: %v", name, s, *value, err)
+			return
+		}
+		*value = parsed
+	}
+}
+
+func durationFromEnv(name string, value *time.Duration) {
+	if s := os.Getenv(name); s != "" {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			log.Warningf("Ignoring %s=%q, using %v: %v", name, s, *value, err)
+			return
+		}
+		*value = parsed
+	}
+}
+
+func intFromEnv(name string, value *int) {
+	if s := os.Getenv(name); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil {
+			log.Warningf("Ignoring %s=%q, using %v: %v", name, s, *value, err)
+			return
+		}
+		*value = parsed
+	}
+}
+
+func (o *Options) kubeletSocket() string {
+	return filepath.Join(o.DevicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+}
+
+func (o *Options) serverSocket() string {
+	return filepath.Join(o.DevicePluginPath, serverSockName)
+}
+
+func (o *Options) checkpointPath() string {
+	if o.KubeletCheckpoint != "" {
+		return o.KubeletCheckpoint
+	}
+	return filepath.Join(o.DevicePluginPath, kubeletCheckpointName)
+}
+
+func (o *Options) memorySocket() string {
+	return filepath.Join(o.DevicePluginPath, memorySockName)
+}
+
+func (o *Options) replicaSocket() string {
+	return filepath.Join(o.DevicePluginPath, replicaSockName)
+}
+
+// migSocket is the socket serving the MIG instances of profile.
+func (o *Options) migSocket(profile string) string {
+	return filepath.Join(o.DevicePluginPath, migSockPrefix+profile+".sock")
+}
+
+// replicasInPlace reports whether the replicas replace the whole gpus of
+// aliyun.com/gpu.
+func (o *Options) replicasInPlace() bool {
+	return o.Replicas != "" && (o.ReplicaResourceName == "" || o.ReplicaResourceName == resourceName)
+}
+
+// recoveryInterval is how often the unhealthy gpus are checked for recovery.
+func (o *Options) recoveryInterval() time.Duration {
+	interval := o.HealthRecoveryPeriod / 2
+	if interval > maxRecoveryInterval {
+		interval = maxRecoveryInterval
+	}
+	if interval < minRecoveryInterval {
+		interval = minRecoveryInterval
+	}
+	return interval
+}
+
+// memoryUnitMiB is the size of a memory share in MiB.
+func (o *Options) memoryUnitMiB() uint64 {
+	if o.MemoryUnit == MiBMemoryUnit {
+		return 1
+	}
+	return 1024
+}
+
+func (o *Options) ledgerPath() string {
+	return filepath.Join(o.DevicePluginPath, ledgerName)
+}
@@ -0,0 +1,46 @@
+package nvidia
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewOptionsFromEnv(t *testing.T) {
+	env := map[string]string{
+		envAssumeTimeout:       "5m",
+		envPreStartRequired:    "true",
+		envHealthFlapThreshold: "3",
+		// Malformed, the defaults stay.
+		envHealthFlapWindow: "10 minutes",
+		envHealthProbe:      "nope",
+	}
+	for name, value := range env {
+		old, ok := os.LookupEnv(name)
+		defer func(name, old string, ok bool) {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name, old, ok)
+		os.Setenv(name, value)
+	}
+
+	opts := NewOptionsFromEnv()
+	if opts.AssumeTimeout != 5*time.Minute {
+		t.Errorf("expected the assume timeout 5m, got %v", opts.AssumeTimeout)
+	}
+	if !opts.PreStartRequired {
+		t.Errorf("expected PreStartRequired")
+	}
+	if opts.HealthFlapThreshold != 3 {
+		t.Errorf("expected the flap threshold 3, got %d", opts.HealthFlapThreshold)
+	}
+	if opts.HealthFlapWindow != defaultHealthFlapWindow {
+		t.Errorf("expected the default flap window on a malformed value, got %v", opts.HealthFlapWindow)
+	}
+	if !opts.HealthProbe {
+		t.Errorf("expected the default health probe on a malformed value")
+	}
+}
@@ -0,0 +1,144 @@
+package nvidia
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	listerv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	podCacheResync = 5 * time.Minute
+	// podCacheSyncTimeout bounds how long an allocation waits for the first
+	// list of the pods when kubelet gives no deadline.
+	podCacheSyncTimeout = 30 * time.Second
+)
+
+// podCache is an informer backed view of the pods bound to the node, so
+// allocations don't list the pods from the API server each time.
+type podCache struct {
+	kube     *KubeClient
+	informer cache.SharedIndexInformer
+	lister   listerv1.PodLister
+}
+
+func newPodCache(kube *KubeClient) *podCache {
+	informer := coreinformers.NewFilteredPodInformer(
+		kube.Clientset,
+		v1.NamespaceAll,
+		podCacheResync,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", kube.NodeName).String()
+		})
+	return &podCache{
+		kube:     kube,
+		informer: informer,
+		lister:   listerv1.NewPodLister(informer.GetIndexer()),
+	}
+}
+
+// run fills and updates the cache until stop is closed.
+func (c *podCache) run(stop <-chan struct{}) {
+	log.Infof("Starting the pod cache of node %s", c.kube.NodeName)
+	c.informer.Run(stop)
+}
+
+// list returns copies of the cached pods in the given phase, or of all the
+// pods when phase is empty. It waits for the cache to sync first.
+func (c *podCache) list(ctx context.Context, phase v1.PodPhase) ([]*v1.Pod, error) {
+	if !c.informer.HasSynced() {
+		ctx, cancel := context.WithTimeout(ctx, podCacheSyncTimeout)
+		defer cancel()
+		if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+			return nil, fmt.Errorf("pod cache of node %s not synced: %v", c.kube.NodeName, ctx.Err())
+		}
+	}
+
+	cached, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	pods := []*v1.Pod{}
+	for _, pod := range cached {
+		if phase == "" || pod.Status.Phase == phase {
+			pods = append(pods, pod.DeepCopy())
+		}
+	}
+	return pods, nil
+}
+
+// liveList is list served by the API server. It is the fallback for pods
+// the cache has not seen yet.
+func (c *podCache) liveList(ctx context.Context, phase v1.PodPhase) ([]*v1.Pod, error) {
+	set := fields.Set{"spec.nodeName": c.kube.NodeName}
+	if phase != "" {
+		set["status.phase"] = string(phase)
+	}
+	podList, err := c.kube.Clientset.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.SelectorFromSet(set).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []*v1.Pod{}
+	for i := range podList.Items {
+		pods = append(pods, &podList.Items[i])
+	}
+	return pods, nil
+}
+
+// refresh returns the cached pending pods stale reports fetched again from
+// the API server, for when their cached copy misses the annotations of the
+// scheduler extender. Pods the cache doesn't have at all can't be fetched by
+// name, the pending pods are listed when no cached pod is stale.
+func (c *podCache) refresh(ctx context.Context, stale func(*v1.Pod) bool) ([]*v1.Pod, error) {
+	cached, err := c.list(ctx, v1.PodPending)
+	if err != nil {
+		return nil, err
+	}
+	refetch := []*v1.Pod{}
+	for _, pod := range cached {
+		if stale(pod) {
+			refetch = append(refetch, pod)
+		}
+	}
+	if len(refetch) == 0 {
+		return c.liveList(ctx, v1.PodPending)
+	}
+
+	pods := []*v1.Pod{}
+	for _, pod := range refetch {
+		latest, err := c.kube.Clientset.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if latest.Status.Phase != v1.PodPending {
+			continue
+		}
+		c.assume(latest)
+		pods = append(pods, latest)
+	}
+	return pods, nil
+}
+
+// assume records a pod the plugin just updated, so the next allocation sees
+// the update even if the watch has not delivered it yet.
+func (c *podCache) assume(pod *v1.Pod) {
+	if err := c.informer.GetIndexer().Update(pod.DeepCopy()); err != nil {
+		log.Warningf("Failed to cache pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+	}
+}
@@ -0,0 +1,162 @@
+package nvidia
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// assignPod records on the pod that the gpus of the given containers are
+// handed out. On conflict the annotations are computed again from the latest
+// pod, keeping the gpus of assumePod which kubelet was already told.
+func assignPod(kube *KubeClient, assumePod *v1.Pod, containers []string) (*v1.Pod, error) {
+	group := assumePod.ObjectMeta.Annotations[EnvResourceIndex]
+	return patchAssignment(kube, assumePod, assignAnnotations, func(pod *v1.Pod) map[string]string {
+		if recordsContainers(pod, EnvAssignedContainers, containers) && pod.ObjectMeta.Annotations[EnvResourceIndex] == group {
+			return nil
+		}
+		newPod := updatePodAnnotations(pod, containers)
+		if current := newPod.ObjectMeta.Annotations[EnvResourceIndex]; current != group {
+			log.Warningf("GPU group of pod %s in ns %s changed from %s to %s, restoring it",
+				pod.Name,
+				pod.Namespace,
+				group,
+				current)
+			newPod.ObjectMeta.Annotations[EnvResourceIndex] = group
+		}
+		return newPod.ObjectMeta.Annotations
+	})
+}
+
+// assignMemoryPod is assignPod for the memory plugin: it records the gpu and
+// the containers served on the pod.
+func assignMemoryPod(kube *KubeClient, assumePod *v1.Pod, gpu int, containers []string) (*v1.Pod, error) {
+	return patchAssignment(kube, assumePod, memAssignAnnotations, func(pod *v1.Pod) map[string]string {
+		if recordsContainers(pod, EnvMemAssignedContainers, containers) && pod.ObjectMeta.Annotations[EnvMemIdx] == strconv.Itoa(gpu) {
+			return nil
+		}
+		return updateMemoryPodAnnotations(pod, gpu, containers)
+	})
+}
+
+// patchAssignment sets the annotations with the given keys to the ones update
+// computes from the pod. The annotations are written with a merge patch
+// guarded by the resourceVersion of the pod, on conflict update is called
+// again with the latest pod. update returns nil when the pod records the
+// assignment already, the pod is returned as is then.
+func patchAssignment(kube *KubeClient, assumePod *v1.Pod, keys []string, update func(*v1.Pod) map[string]string) (*v1.Pod, error) {
+	pod := assumePod
+
+	var updated *v1.Pod
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		annotations := update(pod)
+		if annotations == nil {
+			log.Infof("Pod %s in ns %s records the assignment already", pod.Name, pod.Namespace)
+			updated = pod
+			return nil
+		}
+
+		var err error
+		updated, err = patchPodAnnotations(kube, pod, annotations, keys)
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+
+		log.Infof("Pod %s in ns %s was modified, retrying with the latest version", pod.Name, pod.Namespace)
+		latest, getErr := kube.Clientset.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		if latest.UID != assumePod.UID {
+			return apierrors.NewNotFound(v1.Resource("pods"), pod.Name)
+		}
+		pod = latest
+		return err
+	})
+
+	switch {
+	case err == nil:
+		return updated, nil
+	case apierrors.IsNotFound(err):
+		return nil, fmt.Errorf("pod %s in ns %s is gone: %v", assumePod.Name, assumePod.Namespace, err)
+	case apierrors.IsConflict(err):
+		return nil, fmt.Errorf("pod %s in ns %s kept changing, giving up: %v", assumePod.Name, assumePod.Namespace, err)
+	case apierrors.IsForbidden(err):
+		return nil, fmt.Errorf("not allowed to patch pod %s in ns %s, check the RBAC rules of the plugin: %v", assumePod.Name, assumePod.Namespace, err)
+	default:
+		return nil, fmt.Errorf("failed to patch pod %s in ns %s: %v", assumePod.Name, assumePod.Namespace, err)
+	}
+}
+
+// recordsContainers reports whether the annotation key of the pod lists all
+// the containers.
+func recordsContainers(pod *v1.Pod, key string, containers []string) bool {
+	recorded := map[string]bool{}
+	for _, name := range strings.Split(pod.ObjectMeta.Annotations[key], ",") {
+		recorded[name] = true
+	}
+	for _, name := range containers {
+		if !recorded[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// addContainers adds the containers missing from the comma separated list.
+func addContainers(value string, containers []string) string {
+	names := []string{}
+	seen := map[string]bool{}
+	if value != "" {
+		names = strings.Split(value, ",")
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+	for _, name := range containers {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// assignAnnotations are the pod annotations owned by the plugin.
+var assignAnnotations = []string{
+	EnvResourceIndex,
+	EnvAssignedFlag,
+	EnvAssignedContainers,
+	EnvResourceAssumeTime,
+}
+
+// patchPodAnnotations sets the annotations with the given keys, which the
+// plugin owns, to their value in annotations. The patch fails with a conflict
+// if pod is not the latest version.
+func patchPodAnnotations(kube *KubeClient, pod *v1.Pod, annotations map[string]string, keys []string) (*v1.Pod, error) {
+	owned := map[string]string{}
+	for _, k := range keys {
+		if v, ok := annotations[k]; ok {
+			owned[k] = v
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": pod.ResourceVersion,
+			"annotations":     owned,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kube.Clientset.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, patch)
+}
@@ -0,0 +1,156 @@
+package nvidia
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// GetPreferredAllocation tells kubelet which of the available gpus to
+// allocate: the best connected set of the requested size holding the gpus
+// kubelet must include and, first, the gpus the scheduler extender assumed
+// for the pod asking. When no such set exists the response is empty and
+// kubelet picks the gpus itself.
+func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	if m.inPlace != nil {
+		return m.inPlace.GetPreferredAllocation(ctx, reqs)
+	}
+
+	responses := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		response := &pluginapi.ContainerPreferredAllocationResponse{}
+		gpus, err := m.preferredGPUs(ctx, req)
+		if err != nil {
+			log.Warningf("No preferred allocation of %d gpus out of %v: %v", req.AllocationSize, req.AvailableDeviceIDs, err)
+		} else {
+			response.DeviceIDs, _ = m.registry.UUIDs(gpus)
+			log.Infof("Preferring GPUs %s out of %v, weakest link %s",
+				formatGPUIndexes(gpus),
+				req.AvailableDeviceIDs,
+				m.gpuTopology.weakestLink(gpus).Abbreviation())
+		}
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	return responses, nil
+}
+
+func (m *NvidiaDevicePlugin) preferredGPUs(ctx context.Context, req *pluginapi.ContainerPreferredAllocationRequest) ([]int, error) {
+	available, err := m.gpuIndexes(req.AvailableDeviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	required, err := m.gpuIndexes(req.MustIncludeDeviceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate hands out the assumed gpus whatever kubelet picks, kubelet
+	// had better pick the same ones.
+	isAvailable := map[int]bool{}
+	for _, gpu := range available {
+		isAvailable[gpu] = true
+	}
+	preferred := append([]int{}, required...)
+	for _, gpu := range m.assumedGPUs(ctx, int(req.AllocationSize)) {
+		if isAvailable[gpu] && !containsGPU(preferred, gpu) {
+			preferred = append(preferred, gpu)
+		}
+	}
+	if len(preferred) <= int(req.AllocationSize) {
+		required = preferred
+	}
+	return selectGPUsIncluding(m.gpuTopology, available, required, int(req.AllocationSize))
+}
+
+// assumedGPUs returns the gpus the scheduler extender assumed for the next
+// container asking for size gpus of the pod Allocate would pick, if any.
+func (m *NvidiaDevicePlugin) assumedGPUs(ctx context.Context, size int) []int {
+	reqs := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{
+		DevicesIDs: make([]string, size),
+	}}}
+	pod, containers, err := m.findAssumedPod(ctx, reqs, false)
+	if err != nil || pod == nil {
+		return nil
+	}
+	assignment, err := getContainerGPUIndexes(pod, m.gpuTopology, m.registry)
+	if err != nil {
+		log.V(4).Infof("Ignoring the gpu assumption of pod %s in ns %s: %v", pod.Name, pod.Namespace, err)
+		return nil
+	}
+	return assignment[containers[0].Name]
+}
+
+func containsGPU(gpus []int, gpu int) bool {
+	for _, g := range gpus {
+		if g == gpu {
+			return true
+		}
+	}
+	return false
+}
+
+// gpuIndexes resolves the device ids kubelet knows the gpus by.
+func (m *NvidiaDevicePlugin) gpuIndexes(ids []string) ([]int, error) {
+	gpus := []int{}
+	for _, id := range ids {
+		d, ok := m.registry.ByUUID(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown device %s", id)
+		}
+		gpus = append(gpus, int(d.Index))
+	}
+	return gpus, nil
+}
+
+// preferSingleGPU picks the devices of a container on a single gpu, for
+// resources carving gpus into several devices. It is the fullest gpu holding
+// the request and the devices kubelet must include, so the emptier gpus stay
+// free for bigger requests. gpuOf returns the gpu of a device. The result is
+// nil when no single gpu fits.
+func preferSingleGPU(req *pluginapi.ContainerPreferredAllocationRequest, gpuOf func(id string) (int, bool)) []string {
+	available := map[int][]string{}
+	for _, id := range req.AvailableDeviceIDs {
+		if gpu, ok := gpuOf(id); ok {
+			available[gpu] = append(available[gpu], id)
+		}
+	}
+	required := map[string]bool{}
+	gpus := map[int]bool{}
+	for _, id := range req.MustIncludeDeviceIDs {
+		gpu, ok := gpuOf(id)
+		if !ok {
+			return nil
+		}
+		required[id] = true
+		gpus[gpu] = true
+	}
+	if len(gpus) > 1 {
+		return nil
+	}
+
+	best := -1
+	for gpu, ids := range available {
+		if len(ids) < int(req.AllocationSize) || (len(gpus) == 1 && !gpus[gpu]) {
+			continue
+		}
+		if best < 0 || len(ids) < len(available[best]) || (len(ids) == len(available[best]) && gpu < best) {
+			best = gpu
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	ids := append([]string{}, req.MustIncludeDeviceIDs...)
+	for _, id := range available[best] {
+		if len(ids) == int(req.AllocationSize) {
+			break
+		}
+		if !required[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,139 @@
+package nvidia
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// PreStartContainer is called by kubelet before it starts a container on the
+// devices of the request when PreStartRequired is set. It fails when one of
+// the gpus Allocate handed to the container is not ready, which keeps the
+// container from starting.
+func (m *NvidiaDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if m.inPlace != nil {
+		return m.inPlace.PreStartContainer(ctx, req)
+	}
+	if !m.opts.PreStartRequired {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	ids := m.injectedGPUs(req.DevicesIDs)
+	problems := m.checkDevices(ctx, ids, true)
+	if len(problems) == 0 {
+		log.V(4).Infof("GPUs %v are ready", ids)
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	message := strings.Join(problems, "; ")
+	log.Warningf("Refusing to start a container on gpus %v: %s", ids, message)
+	m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeWarning, reasonGPUNotReady,
+		"Refused to start a container on GPUs %s: %s", strings.Join(ids, ","), message)
+	return nil, status.Errorf(codes.FailedPrecondition, "gpus not ready: %s", message)
+}
+
+// injectedGPUs returns the UUIDs of the gpus Allocate handed to the
+// container kubelet picked the given devices for. They differ from the
+// devices when the scheduler extender assigned the gpus. The devices are the
+// gpus when the ledger doesn't know them.
+func (m *NvidiaDevicePlugin) injectedGPUs(devices []string) []string {
+	if e, ok := m.ledger.lookup(resourceName, devices); ok {
+		return e.GPUs
+	}
+	log.V(4).Infof("No allocation recorded for devices %v, checking them", devices)
+	return devices
+}
+
+// preStartShared is PreStartContainer for the devices with the given ids
+// carved out of gpus, which other containers may use too.
+func (m *NvidiaDevicePlugin) preStartShared(ctx context.Context, ids []string, gpus []int) (*pluginapi.PreStartContainerResponse, error) {
+	uuids, err := m.registry.UUIDs(gpus)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "gpus not ready: %v", err)
+	}
+	problems := m.checkDevices(ctx, uuids, false)
+	if len(problems) == 0 {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	message := strings.Join(problems, "; ")
+	log.Warningf("Refusing to start a container on devices %v: %s", ids, message)
+	m.recorder.Eventf(m.recorder.nodeRef(), v1.EventTypeWarning, reasonGPUNotReady,
+		"Refused to start a container on GPUs %s: %s", formatGPUIndexes(gpus), message)
+	return nil, status.Errorf(codes.FailedPrecondition, "gpus not ready: %s", message)
+}
+
+// checkDevices returns why the devices with the given ids can't be handed to
+// a new container. Processes still running on the gpus only count when
+// exclusive is set.
+func (m *NvidiaDevicePlugin) checkDevices(ctx context.Context, ids []string, exclusive bool) []string {
+	maintenance, err := m.maintenanceGPUs(ctx)
+	if err != nil {
+		log.Warningf("Not checking the gpus under maintenance: %v", err)
+	}
+
+	problems := []string{}
+	for _, id := range ids {
+		dev, ok := m.registry.ByUUID(id)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown gpu %s", id))
+			continue
+		}
+		if !m.deviceHealthy(id) {
+			problems = append(problems, fmt.Sprintf("gpu %d is unhealthy", dev.Index))
+		}
+		if maintenance[int(dev.Index)] {
+			problems = append(problems, fmt.Sprintf("gpu %d is under maintenance", dev.Index))
+		}
+		if !exclusive {
+			continue
+		}
+		pids, err := m.backend.ComputeProcesses(dev)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("can't list the processes of gpu %d: %v", dev.Index, err))
+		} else if len(pids) > 0 {
+			problems = append(problems, fmt.Sprintf("gpu %d still runs processes %v", dev.Index, pids))
+		}
+	}
+	return problems
+}
+
+func (m *NvidiaDevicePlugin) deviceHealthy(id string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, d := range m.devs {
+		if d.ID == id {
+			return d.Health == pluginapi.Healthy
+		}
+	}
+	return false
+}
+
+// maintenanceGPUs returns the gpus listed by index or UUID in the
+// maintenance annotation of the cached node.
+func (m *NvidiaDevicePlugin) maintenanceGPUs(ctx context.Context) (map[int]bool, error) {
+	node, err := m.nodes.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value := strings.TrimSpace(node.ObjectMeta.Annotations[EnvMaintenanceKey])
+	if value == "" {
+		return nil, nil
+	}
+	gpus, err := m.registry.parseIDs(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %v", EnvMaintenanceKey, value, err)
+	}
+	maintenance := map[int]bool{}
+	for _, gpu := range gpus {
+		maintenance[gpu] = true
+	}
+	return maintenance, nil
+}
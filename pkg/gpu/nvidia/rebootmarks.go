@@ -0,0 +1,104 @@
+package nvidia
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// bootIDPath tells the boot of the node apart from the previous ones.
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// rebootMarksFile is the on-disk form of the reboot marks.
+type rebootMarksFile struct {
+	BootID string `json:"bootID"`
+	// GPUs maps the uuid of the gpus to why they are unhealthy.
+	GPUs map[string]string `json:"gpus"`
+}
+
+// rebootMarks are the gpus unhealthy until the node reboots. They are kept
+// on the host with the boot id of the node, so they outlive restarts of the
+// plugin but not the reboot of the node.
+type rebootMarks struct {
+	path   string
+	bootID string
+
+	sync.Mutex
+	gpus map[string]string
+}
+
+// openRebootMarks loads the marks at path made since the node booted. The
+// marks are kept in memory only when path is empty or the boot id can't be
+// read.
+func openRebootMarks(path string) *rebootMarks {
+	r := &rebootMarks{gpus: map[string]string{}}
+	if path == "" {
+		return r
+	}
+	id, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		log.Warningf("Keeping the gpus unhealthy until reboot in memory only, failed to read the boot id: %v", err)
+		return r
+	}
+	r.path = path
+	r.bootID = strings.TrimSpace(string(id))
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read the reboot marks %s: %v", path, err)
+		}
+		return r
+	}
+	file := rebootMarksFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Warningf("Ignoring the corrupted reboot marks %s: %v", path, err)
+		return r
+	}
+	if file.BootID != r.bootID {
+		log.Infof("Dropping the reboot marks %s of boot %s, the node rebooted", path, file.BootID)
+		return r
+	}
+	for uuid, reason := range file.GPUs {
+		r.gpus[uuid] = reason
+	}
+	return r
+}
+
+// mark keeps the gpu unhealthy until the node reboots.
+func (r *rebootMarks) mark(uuid, reason string) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.gpus[uuid]; ok {
+		return nil
+	}
+	r.gpus[uuid] = reason
+	if r.path == "" {
+		return nil
+	}
+	return r.save()
+}
+
+// list returns the marked gpus by uuid with why they are unhealthy.
+func (r *rebootMarks) list() map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	gpus := make(map[string]string, len(r.gpus))
+	for uuid, reason := range r.gpus {
+		gpus[uuid] = reason
+	}
+	return gpus
+}
+
+// save writes the marks. Must be called with the lock held.
+func (r *rebootMarks) save() error {
+	data, err := json.MarshalIndent(rebootMarksFile{BootID: r.bootID, GPUs: r.gpus}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, data, 0600)
+}
@@ -0,0 +1,42 @@
+package nvidia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRebootMarks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reboot-marks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { bootIDPath = path }(bootIDPath)
+	bootIDPath = filepath.Join(dir, "boot_id")
+	boot := func(id string) {
+		if err := ioutil.WriteFile(bootIDPath, []byte(id+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "marks", "unhealthy-until-reboot.json")
+
+	boot("boot-1")
+	marks := openRebootMarks(path)
+	if err := marks.mark("GPU-0", "XID 79"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"GPU-0": "XID 79"}
+	if gpus := openRebootMarks(path).list(); !reflect.DeepEqual(gpus, expected) {
+		t.Errorf("expected the marks kept across restarts, got %v", gpus)
+	}
+
+	boot("boot-2")
+	if gpus := openRebootMarks(path).list(); len(gpus) != 0 {
+		t.Errorf("expected the marks dropped on reboot, got %v", gpus)
+	}
+}
@@ -0,0 +1,154 @@
+package nvidia
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceRegistry records every identifier of the gpus on the node. The gpu
+// index used in the ALIYUN_COM_GPU_GROUP annotation and in the published
+// topology is the position of the gpu in the registry, which is the driver
+// enumeration order. Containers are always handed gpu UUIDs.
+type deviceRegistry struct {
+	devices []*GPUDevice
+	byUUID  map[string]*GPUDevice
+	byMinor map[uint]*GPUDevice
+	byBusID map[string]*GPUDevice
+}
+
+func newDeviceRegistry(backend Backend) (*deviceRegistry, error) {
+	devs, err := backend.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &deviceRegistry{
+		byUUID:  map[string]*GPUDevice{},
+		byMinor: map[uint]*GPUDevice{},
+		byBusID: map[string]*GPUDevice{},
+	}
+	for i, d := range devs {
+		if d.Index != uint(i) {
+			return nil, fmt.Errorf("gpu %s reported with index %d at position %d", d.UUID, d.Index, i)
+		}
+		if _, ok := r.byUUID[d.UUID]; ok {
+			return nil, fmt.Errorf("duplicated gpu uuid %s", d.UUID)
+		}
+		if other, ok := r.byMinor[d.Minor]; ok {
+			return nil, fmt.Errorf("gpu %s and %s share the minor number %d", other.UUID, d.UUID, d.Minor)
+		}
+		r.devices = append(r.devices, d)
+		r.byUUID[d.UUID] = d
+		r.byMinor[d.Minor] = d
+		r.byBusID[strings.ToLower(d.BusID)] = d
+	}
+	return r, nil
+}
+
+// Len is the number of gpus.
+func (r *deviceRegistry) Len() int {
+	return len(r.devices)
+}
+
+// Devices returns the gpus ordered by index.
+func (r *deviceRegistry) Devices() []*GPUDevice {
+	return r.devices
+}
+
+// ByIndex returns the gpu at index.
+func (r *deviceRegistry) ByIndex(index int) (*GPUDevice, bool) {
+	if index < 0 || index >= len(r.devices) {
+		return nil, false
+	}
+	return r.devices[index], true
+}
+
+// ByUUID returns the gpu with the given UUID.
+func (r *deviceRegistry) ByUUID(uuid string) (*GPUDevice, bool) {
+	d, ok := r.byUUID[uuid]
+	return d, ok
+}
+
+// ByMinor returns the gpu behind /dev/nvidia<minor>.
+func (r *deviceRegistry) ByMinor(minor uint) (*GPUDevice, bool) {
+	d, ok := r.byMinor[minor]
+	return d, ok
+}
+
+// ByBusID returns the gpu at the given PCI bus id.
+func (r *deviceRegistry) ByBusID(busID string) (*GPUDevice, bool) {
+	d, ok := r.byBusID[strings.ToLower(busID)]
+	return d, ok
+}
+
+// resolve returns the index of the gpu named by id, which is either a gpu
+// index or a gpu UUID. Unknown and out of range ids are rejected.
+func (r *deviceRegistry) resolve(id string) (int, error) {
+	id = strings.TrimSpace(id)
+	if index, err := strconv.Atoi(id); err == nil {
+		if _, ok := r.ByIndex(index); !ok {
+			return 0, fmt.Errorf("gpu index %d out of range, the node has %d gpus", index, r.Len())
+		}
+		return index, nil
+	}
+	if d, ok := r.ByUUID(id); ok {
+		return int(d.Index), nil
+	}
+	return 0, fmt.Errorf("unknown gpu %q", id)
+}
+
+// parseIDs parses a comma separated list of gpu indexes or UUIDs, e.g. the
+// value of the ALIYUN_COM_GPU_GROUP annotation, into gpu indexes.
+func (r *deviceRegistry) parseIDs(value string) ([]int, error) {
+	var gpus []int
+	seen := map[int]bool{}
+	for _, id := range strings.Split(value, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		gpu, err := r.resolve(id)
+		if err != nil {
+			return nil, err
+		}
+		if seen[gpu] {
+			return nil, fmt.Errorf("gpu %s listed twice in %q", strings.TrimSpace(id), value)
+		}
+		seen[gpu] = true
+		gpus = append(gpus, gpu)
+	}
+	return gpus, nil
+}
+
+// UUIDs returns the UUIDs of the gpus at the given indexes.
+func (r *deviceRegistry) UUIDs(gpus []int) ([]string, error) {
+	uuids := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		d, ok := r.ByIndex(gpu)
+		if !ok {
+			return nil, fmt.Errorf("gpu index %d out of range, the node has %d gpus", gpu, r.Len())
+		}
+		uuids = append(uuids, d.UUID)
+	}
+	return uuids, nil
+}
+
+// pluginDevices returns the devices advertised to kubelet, ordered by index.
+func (r *deviceRegistry) pluginDevices() []*pluginapi.Device {
+	var devs []*pluginapi.Device
+	for _, d := range r.devices {
+		dev := &pluginapi.Device{
+			ID:     d.UUID,
+			Health: pluginapi.Healthy,
+		}
+		if d.NUMANode != noNUMANode {
+			dev.Topology = &pluginapi.TopologyInfo{
+				Nodes: []*pluginapi.NUMANode{{ID: int64(d.NUMANode)}},
+			}
+		}
+		devs = append(devs, dev)
+	}
+	return devs
+}
@@ -0,0 +1,318 @@
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	replicaSockName = "gputopology-replica.sock"
+	// replicaSeparator joins the gpu UUID and the replica number into the id
+	// of a replica, e.g. GPU-8a9c...::2.
+	replicaSeparator = "::"
+)
+
+// ReplicaDevicePlugin time-slices gpus: every gpu is advertised as several
+// replica devices, each container getting the gpus its replicas belong to.
+// It either serves its own resource next to the NvidiaDevicePlugin or, in
+// place, answers for aliyun.com/gpu through it.
+type ReplicaDevicePlugin struct {
+	*subPlugin
+	gpu *NvidiaDevicePlugin
+	// replicas is the number of replicas of every gpu, by index.
+	replicas []int
+}
+
+func newReplicaDevicePlugin(gpu *NvidiaDevicePlugin) (*ReplicaDevicePlugin, error) {
+	replicas, err := parseReplicas(gpu.opts.Replicas, gpu.registry)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReplicaDevicePlugin{
+		gpu:      gpu,
+		replicas: replicas,
+	}
+	if !gpu.opts.replicasInPlace() {
+		r.subPlugin = newSubPlugin(gpu.opts.replicaSocket(), gpu.opts.ReplicaResourceName)
+	}
+	return r, nil
+}
+
+// resource is the resource the replicas are advertised as.
+func (r *ReplicaDevicePlugin) resource() string {
+	if r.subPlugin == nil {
+		return resourceName
+	}
+	return r.resourceName
+}
+
+// parseReplicas parses the Replicas option into the number of replicas of
+// every gpu. Gpus without a count of their own get the default count, or one
+// replica when there is none.
+func parseReplicas(value string, registry *deviceRegistry) ([]int, error) {
+	counts := map[int]int{}
+	defaultCount := 1
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, count := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			id, count = entry[:i], entry[i+1:]
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid replica count %q in %q", count, value)
+		}
+		if id == "" {
+			defaultCount = n
+			continue
+		}
+		gpu, err := registry.resolve(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replicas %q: %v", value, err)
+		}
+		counts[gpu] = n
+	}
+
+	replicas := make([]int, registry.Len())
+	for i := range replicas {
+		replicas[i] = defaultCount
+		if n, ok := counts[i]; ok {
+			replicas[i] = n
+		}
+	}
+	return replicas, nil
+}
+
+func replicaID(uuid string, replica int) string {
+	return fmt.Sprintf("%s%s%d", uuid, replicaSeparator, replica)
+}
+
+// replicaGPU returns the index of the gpu a replica belongs to.
+func (r *ReplicaDevicePlugin) replicaGPU(id string) (int, error) {
+	i := strings.LastIndex(id, replicaSeparator)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown device %s", id)
+	}
+	d, ok := r.gpu.registry.ByUUID(id[:i])
+	if !ok {
+		return 0, fmt.Errorf("unknown device %s", id)
+	}
+	replica, err := strconv.Atoi(id[i+len(replicaSeparator):])
+	if err != nil || replica < 0 || replica >= r.replicas[d.Index] {
+		return 0, fmt.Errorf("unknown device %s", id)
+	}
+	if r.gpu.migParents[int(d.Index)] {
+		return 0, fmt.Errorf("gpu %d is split in MIG instances", d.Index)
+	}
+	return int(d.Index), nil
+}
+
+// gpuIndexes returns the gpus of the given replicas, each once, in the order
+// they first appear.
+func (r *ReplicaDevicePlugin) gpuIndexes(ids []string) ([]int, error) {
+	gpus := []int{}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		gpu, err := r.replicaGPU(id)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[gpu] {
+			seen[gpu] = true
+			gpus = append(gpus, gpu)
+		}
+	}
+	return gpus, nil
+}
+
+// devices lists the replicas, which are as healthy as their gpu. The gpus
+// split in MIG instances have none.
+func (r *ReplicaDevicePlugin) devices() []*pluginapi.Device {
+	r.gpu.RLock()
+	defer r.gpu.RUnlock()
+
+	devs := []*pluginapi.Device{}
+	for i, d := range r.gpu.registry.Devices() {
+		if r.gpu.migParents[i] {
+			continue
+		}
+		gpu := r.gpu.devs[i]
+		for replica := 0; replica < r.replicas[i]; replica++ {
+			devs = append(devs, &pluginapi.Device{
+				ID:       replicaID(d.UUID, replica),
+				Health:   gpu.Health,
+				Topology: gpu.Topology,
+			})
+		}
+	}
+	return devs
+}
+
+func (r *ReplicaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                r.gpu.opts.PreStartRequired,
+		GetPreferredAllocationAvailable: true,
+	}, nil
+}
+
+// ListAndWatch lists the replicas and sends them again whenever the health of
+// a gpu changes.
+func (r *ReplicaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return r.listAndWatch(s)
+}
+
+// Allocate hands every container the gpus its replicas belong to.
+func (r *ReplicaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	responses := pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		gpus, err := r.gpuIndexes(req.DevicesIDs)
+		if err != nil {
+			r.gpu.recorder.Eventf(r.gpu.recorder.nodeRef(), v1.EventTypeWarning, reasonUnknownGPU,
+				"Kubelet requested unknown GPU replicas %s", strings.Join(req.DevicesIDs, ","))
+			return r.gpu.failAllocation(reqs, err)
+		}
+		uuids, err := r.gpu.registry.UUIDs(gpus)
+		if err != nil {
+			return r.gpu.failAllocation(reqs, err)
+		}
+		response := r.gpu.containerResponse(gpus, uuids)
+		responses.ContainerResponses = append(responses.ContainerResponses, &response)
+		log.Infof("Assigned GPUs %s to a container for replicas %v", formatGPUIndexes(gpus), req.DevicesIDs)
+		if err := r.gpu.ledger.record(nil, "", r.resource(), req.DevicesIDs, uuids); err != nil {
+			log.Warningf("Failed to record the gpus of replicas %v: %v", req.DevicesIDs, err)
+		}
+	}
+	return &responses, nil
+}
+
+// GetPreferredAllocation spreads the replicas of a container over as many
+// gpus as possible, the best connected ones. A single replica goes to the gpu
+// with the most replicas left, so the gpus are evenly shared.
+func (r *ReplicaDevicePlugin) GetPreferredAllocation(ctx context.Context, reqs *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	responses := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range reqs.ContainerRequests {
+		response := &pluginapi.ContainerPreferredAllocationResponse{}
+		ids, err := r.preferredReplicas(req)
+		if err != nil {
+			log.Warningf("No preferred allocation of %d replicas out of %v: %v", req.AllocationSize, req.AvailableDeviceIDs, err)
+		} else {
+			response.DeviceIDs = ids
+		}
+		responses.ContainerResponses = append(responses.ContainerResponses, response)
+	}
+	return responses, nil
+}
+
+func (r *ReplicaDevicePlugin) preferredReplicas(req *pluginapi.ContainerPreferredAllocationRequest) ([]string, error) {
+	size := int(req.AllocationSize)
+	taken := map[string]bool{}
+	ids := []string{}
+	required := []int{}
+	for _, id := range req.MustIncludeDeviceIDs {
+		gpu, err := r.replicaGPU(id)
+		if err != nil {
+			return nil, err
+		}
+		if !taken[id] {
+			taken[id] = true
+			ids = append(ids, id)
+			required = append(required, gpu)
+		}
+	}
+
+	available := map[int][]string{}
+	free := []int{}
+	for _, id := range req.AvailableDeviceIDs {
+		gpu, err := r.replicaGPU(id)
+		if err != nil {
+			return nil, err
+		}
+		if taken[id] {
+			continue
+		}
+		if _, ok := available[gpu]; !ok {
+			free = append(free, gpu)
+		}
+		available[gpu] = append(available[gpu], id)
+	}
+	sort.SliceStable(free, func(i, j int) bool {
+		return len(available[free[i]]) > len(available[free[j]])
+	})
+
+	gpus := []int{}
+	switch {
+	case len(ids) >= size:
+	case size == 1:
+		if len(free) == 0 {
+			return nil, fmt.Errorf("no replica left")
+		}
+		gpus = free[:1]
+	default:
+		requiredGPUs := map[int]bool{}
+		for _, gpu := range required {
+			requiredGPUs[gpu] = true
+		}
+		n := len(requiredGPUs)
+		for _, gpu := range free {
+			if n == size {
+				break
+			}
+			if !requiredGPUs[gpu] {
+				n++
+			}
+		}
+		var err error
+		gpus, err = selectGPUsIncluding(r.gpu.gpuTopology, free, required, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for len(ids) < size {
+		picked := false
+		for _, gpu := range gpus {
+			if len(ids) == size || len(available[gpu]) == 0 {
+				continue
+			}
+			ids = append(ids, available[gpu][0])
+			available[gpu] = available[gpu][1:]
+			picked = true
+		}
+		if !picked {
+			return nil, fmt.Errorf("request %d replicas but only %d are available", size, len(ids))
+		}
+	}
+	return ids, nil
+}
+
+// PreStartContainer refuses to start containers on gpus which are unhealthy
+// or under maintenance. Other processes are expected on a shared gpu.
+func (r *ReplicaDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if !r.gpu.opts.PreStartRequired {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	gpus, err := r.gpuIndexes(req.DevicesIDs)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "gpus not ready: %v", err)
+	}
+	return r.gpu.preStartShared(ctx, req.DevicesIDs, gpus)
+}
+
+// Serve starts the gRPC server and registers the replica resource with
+// Kubelet.
+func (r *ReplicaDevicePlugin) Serve() error {
+	return r.serve(r, r.gpu.opts.kubeletSocket())
+}
@@ -3,6 +3,7 @@
 package nvidia
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"path"
@@ -15,29 +16,61 @@ import (
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
 	resourceName           = "aliyun.com/gpu"
-	serverSock             = pluginapi.DevicePluginPath + "gputopology.sock"
+	serverSockName         = "gputopology.sock"
 	envDisableHealthChecks = "DP_DISABLE_HEALTHCHECKS"
-	allHealthChecks        = "xids"
+	allHealthChecks        = xidsHealthCheck + "," + eccHealthCheck + "," + temperatureHealthCheck + "," + throttleHealthCheck + "," + powerHealthCheck
 )
 
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
-	devs         []*pluginapi.Device
-	realDevNames []string
-	devNameMap   map[string]uint
-	devIndxMap   map[uint]string
-	socket       string
-	gpuTopology  gpuTopology
-
-	stop   chan interface{}
-	health chan *pluginapi.Device
+	devs        []*pluginapi.Device
+	registry    *deviceRegistry
+	socket      string
+	gpuTopology gpuTopology
+	backend     Backend
+	kube        *KubeClient
+	opts        *Options
+	driver      *driverFiles
+	pods        *podCache
+	nodes       *nodeCache
+	ledger      *allocationLedger
+	recorder    *eventRecorder
+	checkpoint  *checkpointCache
+	// plugins serve the gpus as other resources, e.g. aliyun.com/gpu-mem.
+	plugins []sidePlugin
+	// inPlace, when set, serves aliyun.com/gpu instead of whole gpus.
+	inPlace inPlacePlugin
+	// migParents are the gpus split in MIG instances, by index.
+	migParents map[int]bool
+	// migs are the MIG instances served by the MIG plugins.
+	migs []*MIGDevice
+
+	stop chan struct{}
+	// updates fans the aliyun.com/gpu devices out to the ListAndWatch
+	// streams.
+	updates *deviceBroadcaster
+	// healthState is the health state machine of the gpus, guarded by the
+	// lock like the device health.
+	healthState *healthTracker
+	// thresholds runs the health checks beyond xids.
+	thresholds *healthChecker
+	// xidPolicy classifies the XID errors.
+	xidPolicy *xidPolicy
+	// rebootMarks are the gpus unhealthy until the node reboots.
+	rebootMarks *rebootMarks
 
 	server *grpc.Server
+	// allocations serializes the allocations, which may wait on the API
+	// server and so never hold the device lock while they do.
+	allocations sync.Mutex
+	// historyPatches serializes the updates of the health history
+	// annotation, so the latest history is written last.
+	historyPatches sync.Mutex
 	sync.RWMutex
 }
 
@@ -72,65 +105,143 @@ func (t gpuTopologyType) Abbreviation() string {
 		return "NV3"
 	case nvml.FourNVLINKLinks:
 		return "NV4"
+	case nvml.FiveNVLINKLinks:
+		return "NV5"
+	case nvml.SixNVLINKLinks:
+		return "NV6"
 	case nvml.P2PLinkUnknown:
 	}
 	return "N-A"
 }
 
+// isNVLink reports whether the gpus are connected through NVLink rather than PCIe.
+func (t gpuTopologyType) isNVLink() bool {
+	return nvml.P2PLinkType(t) >= nvml.SingleNVLINKLink
+}
+
 // gpuTopology
 type gpuTopology [][]gpuTopologyType
 
 // NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
-func NewNvidiaDevicePlugin() *NvidiaDevicePlugin {
-	devs := getDevices()
-	devNameMap := getDevNameMap()
-	devList := []string{}
-
-	for dev, _ := range devNameMap {
-		devList = append(devList, dev)
+func NewNvidiaDevicePlugin(backend Backend, kube *KubeClient, opts *Options) *NvidiaDevicePlugin {
+	registry, err := newDeviceRegistry(backend)
+	check(err)
+	if opts.NUMAOverrides != "" {
+		check(registry.applyNUMAOverrides(opts.NUMAOverrides))
 	}
-
-	gpuTopology := getGpuTopology()
+	devs := registry.pluginDevices()
+	gpuTopology := getGpuTopology(backend, registry)
 
 	log.Infof("Device List: %v", devs)
 
-	err := patchGPUTopology(gpuTopology)
+	err = patchGPUTopology(kube, gpuTopology)
 	if err != nil {
 		log.Infof("Failed due to %v", err)
 	}
-	
-	err = patchNodeType()
+
+	err = patchNodeType(kube, opts.NodeTypeURL)
 	if err != nil {
 		log.Infof("failed patch node type for reason: %v", err)
 	}
 
-	return &NvidiaDevicePlugin{
-		devs:         devs,
-		realDevNames: devList,
-		devNameMap:   devNameMap,
-		socket:       serverSock,
-		gpuTopology:  gpuTopology,
-
-		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
+	switch opts.AllocationMode {
+	case SchedulerAllocationMode, TopologyAllocationMode:
+	default:
+		check(fmt.Errorf("unknown allocation mode %q", opts.AllocationMode))
 	}
-}
-
-func (m *NvidiaDevicePlugin) GetDeviceNameByIndex(index uint) (name string, found bool) {
-	if len(m.devIndxMap) == 0 {
-		m.devIndxMap = map[uint]string{}
-		for k, v := range m.devNameMap {
-			m.devIndxMap[v] = k
+	switch opts.FailurePolicy {
+	case LegacyFailurePolicy, FailClosedPolicy, RestrictedFailurePolicy:
+	default:
+		check(fmt.Errorf("unknown failure policy %q", opts.FailurePolicy))
+	}
+	switch opts.MemoryUnit {
+	case "", GiBMemoryUnit, MiBMemoryUnit:
+	default:
+		check(fmt.Errorf("unknown memory unit %q", opts.MemoryUnit))
+	}
+	switch opts.MIGStrategy {
+	case NoneMIGStrategy, SingleMIGStrategy, MixedMIGStrategy:
+	default:
+		check(fmt.Errorf("unknown mig strategy %q", opts.MIGStrategy))
+	}
+	if opts.CDIAllocation && opts.CDISpecDir == "" {
+		check(fmt.Errorf("CDI allocation needs a CDI spec dir"))
+	}
+	healthChecks, err := loadHealthChecksConfig(opts.HealthChecksConfig)
+	check(err)
+	thresholds, err := newHealthChecker(healthChecks, disabledHealthChecks())
+	check(err)
+	xidPolicy, err := newXIDPolicy(opts.XIDPolicy)
+	check(err)
+
+	var driver *driverFiles
+	if opts.PassDeviceSpecs || opts.CDISpecDir != "" {
+		driver, err = discoverDriver(opts.ContainerDriverRoot, opts.DriverRoot)
+		check(err)
+	}
+	m := &NvidiaDevicePlugin{
+		devs:        devs,
+		registry:    registry,
+		socket:      opts.serverSocket(),
+		gpuTopology: gpuTopology,
+		backend:     backend,
+		kube:        kube,
+		opts:        opts,
+		driver:      driver,
+		pods:        newPodCache(kube),
+		nodes:       newNodeCache(kube),
+		ledger:      openLedger(opts.ledgerPath()),
+		recorder:    newEventRecorder(kube),
+		checkpoint:  newCheckpointCache(opts.checkpointPath()),
+		migParents:  map[int]bool{},
+
+		stop:        make(chan struct{}),
+		updates:     newDeviceBroadcaster(),
+		healthState: newHealthTracker(opts),
+		thresholds:  thresholds,
+		xidPolicy:   xidPolicy,
+		rebootMarks: openRebootMarks(opts.RebootMarks),
+	}
+	// The gpus split in MIG instances are known before the replicas and the
+	// memory devices, which leave them out.
+	check(m.setupMIG())
+	if opts.MemoryUnit != "" {
+		memory, err := newMemoryDevicePlugin(m)
+		check(err)
+		m.plugins = append(m.plugins, memory)
+	}
+	if opts.Replicas != "" {
+		replicas, err := newReplicaDevicePlugin(m)
+		check(err)
+		if opts.replicasInPlace() {
+			if m.inPlace != nil {
+				check(fmt.Errorf("the %s mig strategy can't be combined with replicas in place of the gpus", SingleMIGStrategy))
+			}
+			m.inPlace = replicas
+		} else {
+			m.plugins = append(m.plugins, replicas)
 		}
-		log.Infof("Get devIndexMap: %v", m.devIndxMap)
 	}
-
-	name, found = m.devIndxMap[index]
-	return name, found
+	if opts.CDISpecDir != "" {
+		// The devices are discovered again on every restart of the plugin,
+		// so is the spec.
+		written, err := writeCDISpec(opts.CDISpecDir, newCDISpec(registry, m.migs, driver))
+		check(err)
+		if written {
+			log.Infof("Wrote CDI spec %s", cdiSpecFile(opts.CDISpecDir))
+		}
+	}
+	// Before the first device list, kubelet must not see these gpus healthy.
+	m.restoreRebootMarks()
+	m.broadcast()
+	return m
 }
 
 func (m *NvidiaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return &pluginapi.DevicePluginOptions{}, nil
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                m.opts.PreStartRequired,
+		GetPreferredAllocationAvailable: true,
+	}, nil
 }
 
 // dial establishes the gRPC communication with the registered device plugin.
@@ -173,6 +284,13 @@ func (m *NvidiaDevicePlugin) Start() error {
 	}
 	conn.Close()
 
+	go m.pods.run(m.stop)
+	if m.opts.PreStartRequired {
+		go m.nodes.run(m.stop)
+	}
+	go m.recorder.run(m.stop)
+	go m.reconcileLedgerPeriodically(m.stop)
+	go m.collectStaleAssumedPods(m.stop)
 	go m.healthcheck()
 
 	return nil
@@ -184,6 +302,9 @@ func (m *NvidiaDevicePlugin) Stop() error {
 		return nil
 	}
 
+	for _, p := range m.plugins {
+		p.Stop()
+	}
 	m.server.Stop()
 	m.server = nil
 	close(m.stop)
@@ -193,6 +314,11 @@ func (m *NvidiaDevicePlugin) Stop() error {
 
 // Register registers the device plugin for the given resourceName with Kubelet.
 func (m *NvidiaDevicePlugin) Register(kubeletEndpoint, resourceName string) error {
+	return register(kubeletEndpoint, m.socket, resourceName)
+}
+
+// register registers the plugin listening on socket for resourceName.
+func register(kubeletEndpoint, socket, resourceName string) error {
 	conn, err := dial(kubeletEndpoint, 5*time.Second)
 	if err != nil {
 		return err
@@ -202,7 +328,7 @@ func (m *NvidiaDevicePlugin) Register(kubeletEndpoint, resourceName string) erro
 	client := pluginapi.NewRegistrationClient(conn)
 	reqt := &pluginapi.RegisterRequest{
 		Version:      pluginapi.Version,
-		Endpoint:     path.Base(m.socket),
+		Endpoint:     path.Base(socket),
 		ResourceName: resourceName,
 	}
 
@@ -215,26 +341,52 @@ func (m *NvidiaDevicePlugin) Register(kubeletEndpoint, resourceName string) erro
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	return m.updates.stream(s, m.stop)
+}
 
-	for {
-		select {
-		case <-m.stop:
-			return nil
-		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
-		}
+// broadcast sends the current devices of every resource to kubelet.
+func (m *NvidiaDevicePlugin) broadcast() {
+	m.updates.publish(m.deviceSnapshot())
+	for _, p := range m.plugins {
+		p.publish(p.devices())
 	}
 }
 
-func (m *NvidiaDevicePlugin) unhealthy(dev *pluginapi.Device) {
-	m.health <- dev
+// deviceSnapshot copies the devices advertised as aliyun.com/gpu, so their
+// health can change while they are sent.
+func (m *NvidiaDevicePlugin) deviceSnapshot() []*pluginapi.Device {
+	if m.inPlace != nil {
+		return m.inPlace.devices()
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	devs := []*pluginapi.Device{}
+	for _, d := range m.listDevices() {
+		dev := *d
+		devs = append(devs, &dev)
+	}
+	return devs
 }
 
-func (m *NvidiaDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return &pluginapi.PreStartContainerResponse{}, nil
+// listDevices returns the devices advertised as aliyun.com/gpu, the ones of
+// the in place plugin when there is one. Gpus split in MIG instances are
+// left out.
+func (m *NvidiaDevicePlugin) listDevices() []*pluginapi.Device {
+	if m.inPlace != nil {
+		return m.inPlace.devices()
+	}
+	if len(m.migParents) == 0 {
+		return m.devs
+	}
+	devs := []*pluginapi.Device{}
+	for i, d := range m.devs {
+		if !m.migParents[i] {
+			devs = append(devs, d)
+		}
+	}
+	return devs
 }
 
 func (m *NvidiaDevicePlugin) cleanup() error {
@@ -245,18 +397,39 @@ func (m *NvidiaDevicePlugin) cleanup() error {
 	return nil
 }
 
-func (m *NvidiaDevicePlugin) healthcheck() {
+// disabledHealthChecks returns the health checks DP_DISABLE_HEALTHCHECKS
+// turns off, comma separated.
+func disabledHealthChecks() string {
 	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
 	if disableHealthChecks == "all" {
 		disableHealthChecks = allHealthChecks
 	}
+	return disableHealthChecks
+}
+
+func (m *NvidiaDevicePlugin) healthcheck() {
+	disableHealthChecks := disabledHealthChecks()
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	var xids chan *pluginapi.Device
-	if !strings.Contains(disableHealthChecks, "xids") {
-		xids = make(chan *pluginapi.Device)
-		go watchXIDs(ctx, m.devs, xids)
+	var xids chan healthEvent
+	if !strings.Contains(disableHealthChecks, xidsHealthCheck) {
+		xids = make(chan healthEvent)
+		go watchXIDs(ctx, m.backend, m.registry, m.devs, m.xidPolicy, xids)
+		go m.xidPolicy.watch(ctx)
+	}
+
+	var thresholds chan healthEvent
+	if len(m.thresholds.checks) > 0 {
+		thresholds = make(chan healthEvent)
+		go m.watchThresholds(m.thresholds, m.stop, thresholds)
+	}
+
+	var recovery <-chan time.Time
+	if m.opts.HealthRecoveryPeriod > 0 {
+		ticker := time.NewTicker(m.opts.recoveryInterval())
+		defer ticker.Stop()
+		recovery = ticker.C
 	}
 
 	for {
@@ -264,9 +437,20 @@ func (m *NvidiaDevicePlugin) healthcheck() {
 		case <-m.stop:
 			cancel()
 			return
-		case dev := <-xids:
-			m.unhealthy(dev)
+		case e := <-xids:
+			if !m.markUnhealthy(e) {
+				continue
+			}
+		case e := <-thresholds:
+			if !m.markUnhealthy(e) {
+				continue
+			}
+		case <-recovery:
+			if !m.recoverDevices() {
+				continue
+			}
 		}
+		m.broadcast()
 	}
 }
 
@@ -277,9 +461,9 @@ func (m *NvidiaDevicePlugin) Serve() error {
 		log.Infof("Could not start device plugin: %s", err)
 		return err
 	}
-	log.Infof("Starting to serve on", m.socket)
+	log.Infof("Starting to serve on %s", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, resourceName)
+	err = m.Register(m.opts.kubeletSocket(), resourceName)
 	if err != nil {
 		log.Infof("Could not register device plugin: %s", err)
 		m.Stop()
@@ -287,5 +471,12 @@ func (m *NvidiaDevicePlugin) Serve() error {
 	}
 	log.Infof("Registered device plugin with Kubelet: %v", resourceName)
 
+	for _, p := range m.plugins {
+		if err := p.Serve(); err != nil {
+			m.Stop()
+			return err
+		}
+	}
+
 	return nil
 }
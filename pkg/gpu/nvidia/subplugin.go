@@ -0,0 +1,128 @@
+package nvidia
+
+import (
+	"net"
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// sidePlugin serves the gpus of the NvidiaDevicePlugin as another resource.
+type sidePlugin interface {
+	Serve() error
+	Stop() error
+	// devices lists the devices of the resource.
+	devices() []*pluginapi.Device
+	// publish sends a new device list to kubelet.
+	publish([]*pluginapi.Device)
+}
+
+// inPlacePlugin hands out the gpus of aliyun.com/gpu in another form than
+// whole gpus, e.g. as replicas. The NvidiaDevicePlugin forwards the calls of
+// kubelet to it.
+type inPlacePlugin interface {
+	devices() []*pluginapi.Device
+	Allocate(context.Context, *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error)
+	GetPreferredAllocation(context.Context, *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error)
+	PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error)
+}
+
+// subPlugin serves another resource than aliyun.com/gpu on its own socket,
+// next to the NvidiaDevicePlugin whose gpus it hands out in another form.
+type subPlugin struct {
+	socket       string
+	resourceName string
+
+	// updates fans the device list out to the ListAndWatch streams.
+	updates *deviceBroadcaster
+	stop    chan struct{}
+	server  *grpc.Server
+}
+
+func newSubPlugin(socket, resourceName string) *subPlugin {
+	return &subPlugin{
+		socket:       socket,
+		resourceName: resourceName,
+		updates:      newDeviceBroadcaster(),
+		stop:         make(chan struct{}),
+	}
+}
+
+// publish sends a new device list to every ListAndWatch stream.
+func (p *subPlugin) publish(devs []*pluginapi.Device) {
+	p.updates.publish(devs)
+}
+
+// listAndWatch sends the latest device list and every later one.
+func (p *subPlugin) listAndWatch(s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	return p.updates.stream(s, p.stop)
+}
+
+// start starts the gRPC server of impl.
+func (p *subPlugin) start(impl pluginapi.DevicePluginServer) error {
+	if err := p.cleanup(); err != nil {
+		return err
+	}
+
+	sock, err := net.Listen("unix", p.socket)
+	if err != nil {
+		return err
+	}
+
+	p.server = grpc.NewServer([]grpc.ServerOption{}...)
+	pluginapi.RegisterDevicePluginServer(p.server, impl)
+
+	go p.server.Serve(sock)
+
+	// Wait for server to start by launching a blocking connexion
+	conn, err := dial(p.socket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	return nil
+}
+
+// Stop stops the gRPC server.
+func (p *subPlugin) Stop() error {
+	if p.server == nil {
+		return nil
+	}
+
+	p.server.Stop()
+	p.server = nil
+	close(p.stop)
+
+	return p.cleanup()
+}
+
+func (p *subPlugin) cleanup() error {
+	if err := os.Remove(p.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// serve starts the gRPC server of impl and registers it with Kubelet.
+func (p *subPlugin) serve(impl pluginapi.DevicePluginServer, kubeletSocket string) error {
+	if err := p.start(impl); err != nil {
+		log.Infof("Could not start the %s device plugin: %s", p.resourceName, err)
+		return err
+	}
+	log.Infof("Starting to serve on %s", p.socket)
+
+	if err := register(kubeletSocket, p.socket, p.resourceName); err != nil {
+		log.Infof("Could not register the %s device plugin: %s", p.resourceName, err)
+		p.Stop()
+		return err
+	}
+	log.Infof("Registered device plugin with Kubelet: %v", p.resourceName)
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package nvidia
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// link returns the connection between gpu i and j. getGpuTopology only
+// fills the upper triangle of the matrix.
+func (t gpuTopology) link(i, j int) gpuTopologyType {
+	if i > j {
+		i, j = j, i
+	}
+	if i == j || j >= len(t) {
+		return gpuTopologyType(nvml.P2PLinkUnknown)
+	}
+	return t[i][j]
+}
+
+// linkScore ranks a connection, higher is better: NVLink (the more links the
+// better), then same board, PIX, PXB, PHB, NODE and SYS. This happens to be
+// the order of the nvml link types.
+func linkScore(t gpuTopologyType) int {
+	return int(t)
+}
+
+// score sums the link scores of every pair in gpus.
+func (t gpuTopology) score(gpus []int) int {
+	total := 0
+	for a := 0; a < len(gpus); a++ {
+		for b := a + 1; b < len(gpus); b++ {
+			total += linkScore(t.link(gpus[a], gpus[b]))
+		}
+	}
+	return total
+}
+
+// weakestLink returns the worst connection between the gpus of a set.
+func (t gpuTopology) weakestLink(gpus []int) gpuTopologyType {
+	weakest := gpuTopologyType(nvml.P2PLinkUnknown)
+	for a := 0; a < len(gpus); a++ {
+		for b := a + 1; b < len(gpus); b++ {
+			l := t.link(gpus[a], gpus[b])
+			if weakest == gpuTopologyType(nvml.P2PLinkUnknown) || linkScore(l) < linkScore(weakest) {
+				weakest = l
+			}
+		}
+	}
+	return weakest
+}
+
+// linkDescription tells how the gpus of a set are connected at worst, e.g.
+// "NVLink (NV2)". It is empty for a single gpu.
+func (t gpuTopology) linkDescription(gpus []int) string {
+	if len(gpus) < 2 {
+		return ""
+	}
+	weakest := t.weakestLink(gpus)
+	if weakest.isNVLink() {
+		return fmt.Sprintf("NVLink (%s)", weakest.Abbreviation())
+	}
+	return fmt.Sprintf("PCIe (%s)", weakest.Abbreviation())
+}
+
+// selectGPUs picks the n gpus out of free with the best connections between
+// them. Ties go to the lowest indexes.
+func selectGPUs(topology gpuTopology, free []int, n int) ([]int, error) {
+	return selectGPUsIncluding(topology, free, nil, n)
+}
+
+// selectGPUsIncluding is selectGPUs for sets which must contain the gpus in
+// required, whether they are in free or not.
+func selectGPUsIncluding(topology gpuTopology, free []int, required []int, n int) ([]int, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid gpu count %d", n)
+	}
+	isRequired := map[int]bool{}
+	for _, gpu := range required {
+		isRequired[gpu] = true
+	}
+	if len(isRequired) > n {
+		return nil, fmt.Errorf("request %d gpus but %d are required", n, len(isRequired))
+	}
+	candidates := []int{}
+	for _, gpu := range free {
+		if !isRequired[gpu] {
+			candidates = append(candidates, gpu)
+		}
+	}
+	sort.Ints(candidates)
+	if n > len(isRequired)+len(candidates) {
+		return nil, fmt.Errorf("request %d gpus but only %d are free", n, len(isRequired)+len(candidates))
+	}
+
+	var (
+		best      []int
+		bestScore = -1
+		current   = make([]int, 0, n)
+	)
+	for gpu := range isRequired {
+		current = append(current, gpu)
+	}
+	var walk func(start int)
+	walk = func(start int) {
+		if len(current) == n {
+			if s := topology.score(current); s > bestScore {
+				bestScore = s
+				best = append(best[:0], current...)
+			}
+			return
+		}
+		for i := start; i <= len(candidates)-(n-len(current)); i++ {
+			current = append(current, candidates[i])
+			walk(i + 1)
+			current = current[:len(current)-1]
+		}
+	}
+	walk(0)
+
+	sort.Ints(best)
+	return best, nil
+}
+
+// splitGPUs partitions gpus into groups of the given sizes, each group being
+// as well connected as possible. Bigger groups pick first.
+func splitGPUs(topology gpuTopology, gpus []int, sizes []int) ([][]int, error) {
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	if total != len(gpus) {
+		return nil, fmt.Errorf("can't split %d gpus into groups of %v", len(gpus), sizes)
+	}
+
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return sizes[order[a]] > sizes[order[b]]
+	})
+
+	groups := make([][]int, len(sizes))
+	remaining := append([]int{}, gpus...)
+	for _, i := range order {
+		if sizes[i] == 0 {
+			continue
+		}
+		group, err := selectGPUs(topology, remaining, sizes[i])
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = group
+
+		picked := map[int]bool{}
+		for _, gpu := range group {
+			picked[gpu] = true
+		}
+		left := remaining[:0]
+		for _, gpu := range remaining {
+			if !picked[gpu] {
+				left = append(left, gpu)
+			}
+		}
+		remaining = left
+	}
+	return groups, nil
+}
+
+// formatGPUIndexes renders gpu indexes the way they are stored in the
+// ALIYUN_COM_GPU_GROUP annotation, e.g. "0,1".
+func formatGPUIndexes(gpus []int) string {
+	ids := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		ids = append(ids, strconv.Itoa(gpu))
+	}
+	return strings.Join(ids, ",")
+}
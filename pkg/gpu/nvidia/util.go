@@ -1,12 +1,19 @@
 package nvidia
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/golang/glog"
 	"k8s.io/api/core/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 // Get GPU Memory of the Pod
@@ -38,11 +45,11 @@ func getAssumeTimeFromPodAnnotation(pod *v1.Pod) (assumeTime uint64) {
 func getGPUIDsFromPodAnnotation(pod *v1.Pod) (ids string) {
 	if len(pod.ObjectMeta.Annotations) > 0 {
 		value, found := pod.ObjectMeta.Annotations[EnvResourceIndex]
-		log.Warningf("Failed to get the dev ", pod.ObjectMeta.Annotations[EnvResourceIndex])
+		log.V(4).Infof("Found dev ids %s for pod %s in ns %s", value, pod.Name, pod.Namespace)
 		if found && len(value) != 0 {
 			ids = value
 		} else {
-			log.Warningf("Failed to get dev id %s for pod %s in ns %s",
+			log.Warningf("Failed to get dev id for pod %s in ns %s",
 				pod.Name,
 				pod.Namespace)
 		}
@@ -50,16 +57,234 @@ func getGPUIDsFromPodAnnotation(pod *v1.Pod) (ids string) {
 	return ids
 }
 
-//  update pod env with assigned status
-func updatePodAnnotations(oldPod *v1.Pod) (newPod *v1.Pod) {
+// get the gpu count a container asks for
+func getGPUCountFromContainer(container *v1.Container) uint {
+	if val, ok := container.Resources.Limits[resourceName]; ok {
+		return uint(val.Value())
+	}
+	return 0
+}
+
+// get the containers of the pod asking for gpus, in spec order
+func getGPUContainers(pod *v1.Pod) []v1.Container {
+	containers := []v1.Container{}
+	for _, container := range pod.Spec.Containers {
+		if getGPUCountFromContainer(&container) > 0 {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+// get the gpu containers of the pod which have not been allocated yet
+func getPendingGPUContainers(pod *v1.Pod) []v1.Container {
+	assigned := map[string]bool{}
+	for _, name := range strings.Split(pod.ObjectMeta.Annotations[EnvAssignedContainers], ",") {
+		assigned[name] = true
+	}
+
+	containers := []v1.Container{}
+	for _, container := range getGPUContainers(pod) {
+		if !assigned[container.Name] {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+// matchGPUContainers returns the containers of the pod the container requests
+// are for. kubelet allocates the containers of a pod one after the other in
+// spec order, so they are the next pending gpu containers asking for as many
+// gpus as the requests carry.
+func matchGPUContainers(pod *v1.Pod, reqs *pluginapi.AllocateRequest) ([]v1.Container, bool) {
+	pending := getPendingGPUContainers(pod)
+	if len(reqs.ContainerRequests) == 0 || len(reqs.ContainerRequests) > len(pending) {
+		return nil, false
+	}
+	for i, req := range reqs.ContainerRequests {
+		if getGPUCountFromContainer(&pending[i]) != uint(len(req.DevicesIDs)) {
+			return nil, false
+		}
+	}
+	return pending[:len(reqs.ContainerRequests)], true
+}
+
+// parseGPUGroup parses the ALIYUN_COM_GPU_GROUP annotation. The per container
+// format {"c1":"0,1","c2":"2"} returns the gpus by container name, the pod
+// wide format "0,1,2" returns them under the empty name.
+func parseGPUGroup(value string, registry *deviceRegistry) (map[string][]int, error) {
+	value = strings.TrimSpace(value)
+	groups := map[string]string{}
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), &groups); err != nil {
+			return nil, fmt.Errorf("invalid gpu group %s: %v", value, err)
+		}
+	} else {
+		groups[""] = value
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := map[string][]int{}
+	owners := map[int]string{}
+	for _, name := range names {
+		gpus, err := registry.parseIDs(groups[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, gpu := range gpus {
+			if owner, ok := owners[gpu]; ok {
+				return nil, fmt.Errorf("gpu %d assigned to both containers %s and %s", gpu, owner, name)
+			}
+			owners[gpu] = name
+		}
+		result[name] = gpus
+	}
+	return result, nil
+}
+
+// formatGPUGroup is the inverse of parseGPUGroup.
+func formatGPUGroup(groups map[string][]int) string {
+	if gpus, ok := groups[""]; ok && len(groups) == 1 {
+		return formatGPUIndexes(gpus)
+	}
+	values := map[string]string{}
+	for name, gpus := range groups {
+		values[name] = formatGPUIndexes(gpus)
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// getContainerGPUIndexes returns the gpus of every gpu container of the pod.
+// Pod wide assignments are split between the containers by topology.
+func getContainerGPUIndexes(pod *v1.Pod, topology gpuTopology, registry *deviceRegistry) (map[string][]int, error) {
+	groups, err := parseGPUGroup(getGPUIDsFromPodAnnotation(pod), registry)
+	if err != nil {
+		return nil, err
+	}
+	containers := getGPUContainers(pod)
+
+	if gpus, ok := groups[""]; ok {
+		if len(gpus) == 0 {
+			return nil, fmt.Errorf("no gpu assigned")
+		}
+		sizes := []int{}
+		for _, container := range containers {
+			sizes = append(sizes, int(getGPUCountFromContainer(&container)))
+		}
+		if len(containers) == 1 {
+			if len(gpus) != sizes[0] {
+				return nil, fmt.Errorf("container %s asks for %d gpus but is assigned %s",
+					containers[0].Name,
+					sizes[0],
+					formatGPUIndexes(gpus))
+			}
+			return map[string][]int{containers[0].Name: gpus}, nil
+		}
+		split, err := splitGPUs(topology, gpus, sizes)
+		if err != nil {
+			return nil, err
+		}
+		result := map[string][]int{}
+		for i, container := range containers {
+			result[container.Name] = split[i]
+		}
+		return result, nil
+	}
+
+	for _, container := range containers {
+		gpus, ok := groups[container.Name]
+		if !ok {
+			return nil, fmt.Errorf("no gpu assigned to container %s", container.Name)
+		}
+		if uint(len(gpus)) != getGPUCountFromContainer(&container) {
+			return nil, fmt.Errorf("container %s asks for %d gpus but is assigned %s",
+				container.Name,
+				getGPUCountFromContainer(&container),
+				formatGPUIndexes(gpus))
+		}
+	}
+	return groups, nil
+}
+
+// update pod env with assigned status of the given containers, the pod is
+// assigned once all its gpu containers are
+func updatePodAnnotations(oldPod *v1.Pod, containers []string) (newPod *v1.Pod) {
+	newPod = oldPod.DeepCopy()
+	if len(newPod.ObjectMeta.Annotations) == 0 {
+		newPod.ObjectMeta.Annotations = map[string]string{}
+	}
+
+	newPod.ObjectMeta.Annotations[EnvAssignedContainers] = addContainers(newPod.ObjectMeta.Annotations[EnvAssignedContainers], containers)
+
+	now := time.Now()
+	if len(getPendingGPUContainers(newPod)) == 0 {
+		newPod.ObjectMeta.Annotations[EnvAssignedFlag] = "true"
+	} else {
+		newPod.ObjectMeta.Annotations[EnvAssignedFlag] = "false"
+	}
+	newPod.ObjectMeta.Annotations[EnvResourceAssumeTime] = fmt.Sprintf("%d", now.UnixNano())
+
+	return newPod
+}
+
+// assumePodAnnotations records the gpus picked by the plugin on the pod the
+// way the scheduler extender does
+func assumePodAnnotations(oldPod *v1.Pod, group string) (newPod *v1.Pod) {
 	newPod = oldPod.DeepCopy()
 	if len(newPod.ObjectMeta.Annotations) == 0 {
 		newPod.ObjectMeta.Annotations = map[string]string{}
 	}
 
 	now := time.Now()
-	newPod.ObjectMeta.Annotations[EnvAssignedFlag] = "true"
+	newPod.ObjectMeta.Annotations[EnvResourceIndex] = group
+	newPod.ObjectMeta.Annotations[EnvAssignedFlag] = "false"
 	newPod.ObjectMeta.Annotations[EnvResourceAssumeTime] = fmt.Sprintf("%d", now.UnixNano())
 
 	return newPod
 }
+
+// writeFileAtomic replaces the file at path with data, creating its dir when
+// missing. The data is synced to a temp file renamed into place, so readers
+// and a crash see the old or the new file, never a partial one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// The rename is durable once the dir is synced.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,230 @@
+package nvidia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestRegistry returns the registry of n fake gpus GPU-0...GPU-<n-1>.
+func newTestRegistry(t *testing.T, n int) *deviceRegistry {
+	fixture := &FakeFixture{}
+	for i := 0; i < n; i++ {
+		fixture.GPUs = append(fixture.GPUs, FakeGPU{UUID: fmt.Sprintf("GPU-%d", i)})
+	}
+	backend, err := NewFakeBackend(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := newDeviceRegistry(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestParseGPUGroup(t *testing.T) {
+	registry := newTestRegistry(t, 4)
+	tests := []struct {
+		value    string
+		expected map[string][]int
+		err      string
+	}{
+		{value: "1,2", expected: map[string][]int{"": {1, 2}}},
+		{value: "GPU-3", expected: map[string][]int{"": {3}}},
+		{value: `{"c1":"0,1","c2":"GPU-2"}`, expected: map[string][]int{"c1": {0, 1}, "c2": {2}}},
+		{value: "1,1", err: "listed twice"},
+		{value: "4", err: "out of range"},
+		{value: `{"c1":"0,1","c2":"1"}`, err: "gpu 1 assigned to both containers c1 and c2"},
+		{value: `{"c1":"0","c2":"GPU-0"}`, err: "gpu 0 assigned to both containers c1 and c2"},
+		{value: `{"c1":`, err: "invalid gpu group"},
+	}
+
+	for _, test := range tests {
+		groups, err := parseGPUGroup(test.value, registry)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(groups, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.value, test.expected, groups)
+		}
+	}
+}
+
+func TestGetContainerGPUIndexes(t *testing.T) {
+	registry := newTestRegistry(t, 4)
+	topology := make(gpuTopology, 4)
+	for i := range topology {
+		topology[i] = make([]gpuTopologyType, 4)
+	}
+	container := func(name string, gpus int64) v1.Container {
+		return v1.Container{
+			Name: name,
+			Resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{resourceName: *resource.NewQuantity(gpus, resource.DecimalSI)},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		group      string
+		containers []v1.Container
+		expected   map[string][]int
+		err        string
+	}{
+		{
+			name:       "single container",
+			group:      "0,1",
+			containers: []v1.Container{container("c1", 2)},
+			expected:   map[string][]int{"c1": {0, 1}},
+		},
+		{
+			name:       "single container assigned too many gpus",
+			group:      "0,1",
+			containers: []v1.Container{container("c1", 1)},
+			err:        "container c1 asks for 1 gpus but is assigned 0,1",
+		},
+		{
+			name:       "single container assigned too few gpus",
+			group:      "0",
+			containers: []v1.Container{container("c1", 2)},
+			err:        "container c1 asks for 2 gpus but is assigned 0",
+		},
+		{
+			name:       "pod wide split",
+			group:      "0,1,2",
+			containers: []v1.Container{container("c1", 1), container("c2", 2)},
+		},
+		{
+			name:       "pod wide count mismatch",
+			group:      "0,1",
+			containers: []v1.Container{container("c1", 1), container("c2", 2)},
+			err:        "can't split 2 gpus",
+		},
+		{
+			name:       "per container",
+			group:      `{"c1":"0","c2":"1,2"}`,
+			containers: []v1.Container{container("c1", 1), container("c2", 2)},
+			expected:   map[string][]int{"c1": {0}, "c2": {1, 2}},
+		},
+		{
+			name:       "per container shared gpu",
+			group:      `{"c1":"0","c2":"0,2"}`,
+			containers: []v1.Container{container("c1", 1), container("c2", 2)},
+			err:        "gpu 0 assigned to both containers c1 and c2",
+		},
+		{
+			name:       "per container missing",
+			group:      `{"c1":"0"}`,
+			containers: []v1.Container{container("c1", 1), container("c2", 2)},
+			err:        "no gpu assigned to container c2",
+		},
+	}
+
+	for _, test := range tests {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p", Annotations: map[string]string{EnvResourceIndex: test.group}},
+			Spec:       v1.PodSpec{Containers: test.containers},
+		}
+		assignment, err := getContainerGPUIndexes(pod, topology, registry)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.expected != nil && !reflect.DeepEqual(assignment, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, assignment)
+		}
+		for _, c := range test.containers {
+			if uint(len(assignment[c.Name])) != getGPUCountFromContainer(&c) {
+				t.Errorf("%s: container %s assigned %v", test.name, c.Name, assignment[c.Name])
+			}
+		}
+	}
+}
+
+func TestUpdatePodAnnotationsDedupesContainers(t *testing.T) {
+	container := func(name string) v1.Container {
+		return v1.Container{
+			Name: name,
+			Resources: v1.ResourceRequirements{
+				Limits: v1.ResourceList{resourceName: resource.MustParse("1")},
+			},
+		}
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "p", Annotations: map[string]string{EnvAssignedContainers: "c1"}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{container("c1"), container("c2")}},
+	}
+
+	if !recordsContainers(pod, EnvAssignedContainers, []string{"c1"}) {
+		t.Errorf("expected c1 recorded")
+	}
+	if recordsContainers(pod, EnvAssignedContainers, []string{"c1", "c2"}) {
+		t.Errorf("expected c2 not recorded")
+	}
+
+	// A retry adds c1 again.
+	annotations := updatePodAnnotations(pod, []string{"c1", "c2"}).ObjectMeta.Annotations
+	if assigned := annotations[EnvAssignedContainers]; assigned != "c1,c2" {
+		t.Errorf("expected containers c1,c2, got %q", assigned)
+	}
+	if flag := annotations[EnvAssignedFlag]; flag != "true" {
+		t.Errorf("expected the pod assigned, got %q", flag)
+	}
+
+	annotations = updateMemoryPodAnnotations(pod, 0, []string{"c1"})
+	annotations = updateMemoryPodAnnotations(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}, 0, []string{"c1"})
+	if assigned := annotations[EnvMemAssignedContainers]; assigned != "c1" {
+		t.Errorf("expected memory container c1, got %q", assigned)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "file.json")
+
+	for _, data := range []string{"old", "new"} {
+		if err := writeFileAtomic(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "new" {
+		t.Errorf("expected the new data, got %q: %v", data, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("expected mode 0600, got %v", mode)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("expected no temp file left, got %d files", len(files))
+	}
+}
@@ -0,0 +1,180 @@
+package nvidia
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// xidAction is what a critical XID error does to the gpus.
+type xidAction string
+
+const (
+	// ignoreXID is for application errors, the gpu stays healthy.
+	ignoreXID xidAction = "ignore"
+	// unhealthyXID marks the gpu unhealthy until it recovers.
+	unhealthyXID xidAction = "unhealthy"
+	// rebootXID marks the gpu unhealthy until the node reboots.
+	rebootXID xidAction = "unhealthy-until-reboot"
+	// nodeXID marks every gpu of the node unhealthy until they recover.
+	nodeXID xidAction = "node-unhealthy"
+)
+
+// defaultXIDActions is the default XID table, after
+// http://docs.nvidia.com/deploy/xid-errors/index.html. XIDs it doesn't list
+// mark the gpu unhealthy.
+var defaultXIDActions = map[uint64]xidAction{
+	// Application errors.
+	13: ignoreXID, // graphics engine exception
+	31: ignoreXID, // gpu memory page fault
+	43: ignoreXID, // gpu stopped processing
+	45: ignoreXID, // preemptive cleanup
+	68: ignoreXID, // video processor exception
+	94: ignoreXID, // contained ECC error
+	// Hardware errors only a reset clears.
+	48: rebootXID, // double bit ECC error
+	64: rebootXID, // ECC page retirement failure
+	74: rebootXID, // NVLink error
+	79: rebootXID, // gpu has fallen off the bus
+	92: rebootXID, // high single bit ECC error rate
+	95: rebootXID, // uncontained ECC error
+}
+
+// xidPolicyFile is the XID policy file, e.g.
+//
+//	default: unhealthy
+//	xids:
+//	  "13": unhealthy
+//	  "79": node-unhealthy
+//
+// Its entries override the default table.
+type xidPolicyFile struct {
+	Default xidAction            `json:"default,omitempty"`
+	XIDs    map[string]xidAction `json:"xids,omitempty"`
+}
+
+// xidPolicy classifies critical XID errors. It is reloaded whenever its
+// file changes.
+type xidPolicy struct {
+	path string
+
+	sync.RWMutex
+	fallback xidAction
+	actions  map[uint64]xidAction
+}
+
+// newXIDPolicy returns the XID policy of the file at path, the default table
+// when path is empty.
+func newXIDPolicy(path string) (*xidPolicy, error) {
+	p := &xidPolicy{path: path}
+	fallback, actions, err := readXIDPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	p.fallback, p.actions = fallback, actions
+	return p, nil
+}
+
+func readXIDPolicy(path string) (xidAction, map[uint64]xidAction, error) {
+	actions := map[uint64]xidAction{}
+	for xid, action := range defaultXIDActions {
+		actions[xid] = action
+	}
+	if path == "" {
+		return unhealthyXID, actions, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	file := xidPolicyFile{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return "", nil, fmt.Errorf("invalid XID policy %s: %v", path, err)
+	}
+
+	fallback := unhealthyXID
+	if file.Default != "" {
+		if err := file.Default.validate(); err != nil {
+			return "", nil, fmt.Errorf("invalid XID policy %s: %v", path, err)
+		}
+		fallback = file.Default
+	}
+	for key, action := range file.XIDs {
+		xid, err := strconv.ParseUint(strings.TrimSpace(key), 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid XID policy %s: invalid XID %q", path, key)
+		}
+		if err := action.validate(); err != nil {
+			return "", nil, fmt.Errorf("invalid XID policy %s: XID %d: %v", path, xid, err)
+		}
+		actions[xid] = action
+	}
+	return fallback, actions, nil
+}
+
+func (a xidAction) validate() error {
+	switch a {
+	case ignoreXID, unhealthyXID, rebootXID, nodeXID:
+		return nil
+	}
+	return fmt.Errorf("unknown XID action %q", a)
+}
+
+// action returns what the XID does to the gpus.
+func (p *xidPolicy) action(xid uint64) xidAction {
+	p.RLock()
+	defer p.RUnlock()
+
+	if action, ok := p.actions[xid]; ok {
+		return action
+	}
+	return p.fallback
+}
+
+// reload reads the policy file again, keeping the current policy when it is
+// invalid.
+func (p *xidPolicy) reload() {
+	fallback, actions, err := readXIDPolicy(p.path)
+	if err != nil {
+		log.Warningf("Keeping the current XID policy: %v", err)
+		return
+	}
+
+	p.Lock()
+	p.fallback, p.actions = fallback, actions
+	p.Unlock()
+	log.Infof("Reloaded the XID policy %s", p.path)
+}
+
+// watch reloads the policy whenever its file changes, until ctx is done. The
+// directory is watched, so files swapped in by a ConfigMap update are seen.
+func (p *xidPolicy) watch(ctx context.Context) {
+	if p.path == "" {
+		return
+	}
+	watcher, err := newFSWatcher(filepath.Dir(p.path))
+	if err != nil {
+		log.Warningf("Can't watch the XID policy %s, it won't be reloaded: %v", p.path, err)
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-watcher.Events:
+			p.reload()
+		case err := <-watcher.Errors:
+			log.Warningf("inotify: %s", err)
+		}
+	}
+}
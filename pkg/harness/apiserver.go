@@ -0,0 +1,709 @@
+package harness
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const instanceTypePath = "/latest/meta-data/instance/instance-type"
+
+// FakeAPIServer is an in-memory API server serving the subset of the core/v1
+// API used by the device plugin: nodes, pods and events. It also answers the
+// instance metadata request made to find out the node type.
+type FakeAPIServer struct {
+	// InstanceType is returned by the instance metadata endpoint.
+	InstanceType string
+
+	server *httptest.Server
+	closed chan struct{}
+
+	sync.Mutex
+	resourceVersion uint64
+	nodes           map[string]*v1.Node
+	pods            map[string]*v1.Pod
+	events          []*v1.Event
+	watchers        map[*watcher]bool
+	// changes are the node and pod changes by resource version, which
+	// watches started from an older version replay.
+	changes []change
+}
+
+// object is a node or a pod.
+type object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// change is a change of a node or a pod. old is nil for new objects and obj
+// is nil for deleted ones.
+type change struct {
+	resource        string
+	resourceVersion uint64
+	old, obj        object
+}
+
+// watcher is a watch of nodes or pods opened by a client.
+type watcher struct {
+	resource  string
+	namespace string
+	selector  fields.Selector
+	events    chan *watchEvent
+}
+
+type watchEvent struct {
+	Type   watch.EventType `json:"type"`
+	Object runtime.Object  `json:"object"`
+}
+
+// NewFakeAPIServer starts an API server holding the given nodes.
+func NewFakeAPIServer(nodes ...*v1.Node) *FakeAPIServer {
+	s := &FakeAPIServer{
+		InstanceType: "ecs.gn5-c8g1.2xlarge",
+		closed:       make(chan struct{}),
+		nodes:        map[string]*v1.Node{},
+		pods:         map[string]*v1.Pod{},
+		watchers:     map[*watcher]bool{},
+	}
+	for _, node := range nodes {
+		s.AddNode(node)
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts the server down.
+func (s *FakeAPIServer) Close() {
+	close(s.closed)
+	s.server.Close()
+}
+
+// URL is the address of the server.
+func (s *FakeAPIServer) URL() string {
+	return s.server.URL
+}
+
+// NodeTypeURL is the instance metadata endpoint to use in nvidia.Options.
+func (s *FakeAPIServer) NodeTypeURL() string {
+	return s.server.URL + instanceTypePath
+}
+
+// Clientset returns a clientset talking to the server.
+func (s *FakeAPIServer) Clientset() (kubernetes.Interface, *rest.Config, error) {
+	config := &rest.Config{Host: s.server.URL}
+	clientset, err := kubernetes.NewForConfig(config)
+	return clientset, config, err
+}
+
+func (s *FakeAPIServer) nextResourceVersion() string {
+	s.resourceVersion++
+	return strconv.FormatUint(s.resourceVersion, 10)
+}
+
+// AddNode stores a copy of node.
+func (s *FakeAPIServer) AddNode(node *v1.Node) {
+	s.Lock()
+	defer s.Unlock()
+
+	node = node.DeepCopy()
+	node.ResourceVersion = s.nextResourceVersion()
+	s.notify("nodes", s.node(node.Name), node)
+	s.nodes[node.Name] = node
+}
+
+// Node returns a copy of the named node.
+func (s *FakeAPIServer) Node(name string) (*v1.Node, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	node, ok := s.nodes[name]
+	if !ok {
+		return nil, false
+	}
+	return node.DeepCopy(), true
+}
+
+// AddPod stores a copy of pod, defaulting its namespace and UID. A pod with
+// the same namespace and name is replaced.
+func (s *FakeAPIServer) AddPod(pod *v1.Pod) {
+	s.Lock()
+	defer s.Unlock()
+
+	pod = pod.DeepCopy()
+	if pod.Namespace == "" {
+		pod.Namespace = metav1.NamespaceDefault
+	}
+	if pod.UID == "" {
+		pod.UID = types.UID(fmt.Sprintf("%s-%s-uid", pod.Namespace, pod.Name))
+	}
+	if pod.CreationTimestamp.IsZero() {
+		pod.CreationTimestamp = metav1.Now()
+	}
+	pod.ResourceVersion = s.nextResourceVersion()
+	key := pod.Namespace + "/" + pod.Name
+	s.notify("pods", s.pod(key), pod)
+	s.pods[key] = pod
+}
+
+// Pod returns a copy of the pod namespace/name.
+func (s *FakeAPIServer) Pod(namespace, name string) (*v1.Pod, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	pod, ok := s.pods[namespace+"/"+name]
+	if !ok {
+		return nil, false
+	}
+	return pod.DeepCopy(), true
+}
+
+// DeletePod removes the pod namespace/name.
+func (s *FakeAPIServer) DeletePod(namespace, name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := namespace + "/" + name
+	if pod, ok := s.pods[key]; ok {
+		s.nextResourceVersion()
+		s.notify("pods", pod, nil)
+		delete(s.pods, key)
+	}
+}
+
+// node and pod return the stored node or pod as an object, nil when there
+// is none. Must be called with the lock held.
+func (s *FakeAPIServer) node(name string) object {
+	if node, ok := s.nodes[name]; ok {
+		return node
+	}
+	return nil
+}
+
+func (s *FakeAPIServer) pod(key string) object {
+	if pod, ok := s.pods[key]; ok {
+		return pod
+	}
+	return nil
+}
+
+// notify records the change of resource from old to obj at the current
+// resource version and sends it to the watchers. old is nil for new objects
+// and obj is nil for deleted ones. Must be called with the lock held.
+func (s *FakeAPIServer) notify(resource string, old, obj object) {
+	change := change{resource: resource, resourceVersion: s.resourceVersion, old: old, obj: obj}
+	s.changes = append(s.changes, change)
+	for watcher := range s.watchers {
+		event := watcher.event(change)
+		if event == nil {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			// The client is too slow, end the watch so it relists.
+			close(watcher.events)
+			delete(s.watchers, watcher)
+		}
+	}
+}
+
+// event returns the watch event the change is for the watcher, nil when the
+// watcher doesn't see the object before nor after the change.
+func (w *watcher) event(change change) *watchEvent {
+	if change.resource != w.resource {
+		return nil
+	}
+	wasIn := change.old != nil && w.matches(change.old)
+	isIn := change.obj != nil && w.matches(change.obj)
+
+	eventType, obj := watch.Modified, change.obj
+	switch {
+	case isIn && !wasIn:
+		eventType = watch.Added
+	case wasIn && !isIn:
+		eventType, obj = watch.Deleted, change.old
+	case !isIn:
+		return nil
+	}
+	obj = obj.DeepCopyObject().(object)
+	obj.GetObjectKind().SetGroupVersionKind(schema.GroupVersionKind{Version: "v1", Kind: kinds[w.resource]})
+	if eventType == watch.Deleted {
+		obj.SetResourceVersion(strconv.FormatUint(change.resourceVersion, 10))
+	}
+	return &watchEvent{Type: eventType, Object: obj}
+}
+
+var kinds = map[string]string{"nodes": "Node", "pods": "Pod"}
+
+func (w *watcher) matches(obj object) bool {
+	return (w.namespace == "" || obj.GetNamespace() == w.namespace) && w.selector.Matches(objectFields(obj))
+}
+
+// Events returns copies of the events recorded so far.
+func (s *FakeAPIServer) Events() []*v1.Event {
+	s.Lock()
+	defer s.Unlock()
+
+	events := make([]*v1.Event, 0, len(s.events))
+	for _, e := range s.events {
+		events = append(events, e.DeepCopy())
+	}
+	return events
+}
+
+func (s *FakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == instanceTypePath {
+		w.Write([]byte(s.InstanceType))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/"), "/")
+	var namespace string
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		namespace = parts[1]
+		parts = parts[2:]
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "nodes" && namespace == "":
+		s.serveNodeList(w, r)
+	case len(parts) == 2 && parts[0] == "nodes" && namespace == "":
+		s.serveNode(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "pods":
+		s.servePodList(w, r, namespace)
+	case len(parts) == 2 && parts[0] == "pods" && namespace != "":
+		s.servePod(w, r, namespace, parts[1])
+	case len(parts) == 1 && parts[0] == "events" && namespace != "":
+		s.serveEvents(w, r, namespace)
+	case len(parts) == 2 && parts[0] == "events" && namespace != "":
+		s.serveEvent(w, r, namespace, parts[1])
+	default:
+		writeError(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+	}
+}
+
+func (s *FakeAPIServer) serveNode(w http.ResponseWriter, r *http.Request, name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	resource := schema.GroupResource{Resource: "nodes"}
+	node, ok := s.nodes[name]
+	if !ok {
+		writeError(w, apierrors.NewNotFound(resource, name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		updated := &v1.Node{}
+		if err := readObject(r, updated); err != nil {
+			writeError(w, err)
+			return
+		}
+		if updated.ResourceVersion != "" && updated.ResourceVersion != node.ResourceVersion {
+			writeError(w, apierrors.NewConflict(resource, name, errors.New(optimisticLockErrorMsg)))
+			return
+		}
+		node = updated
+	case http.MethodPatch:
+		patched := &v1.Node{}
+		if err := applyPatch(r, node, patched); err != nil {
+			writeError(w, err)
+			return
+		}
+		node = patched
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(resource, r.Method))
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		node.ResourceVersion = s.nextResourceVersion()
+		s.notify("nodes", s.node(name), node)
+		s.nodes[name] = node
+	}
+	node.TypeMeta = metav1.TypeMeta{Kind: "Node", APIVersion: "v1"}
+	writeObject(w, http.StatusOK, node)
+}
+
+func (s *FakeAPIServer) serveNodeList(w http.ResponseWriter, r *http.Request) {
+	selector, ok := s.listOrWatch(w, r, "nodes", "")
+	if !ok {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	list := &v1.NodeList{
+		TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"},
+		ListMeta: metav1.ListMeta{ResourceVersion: strconv.FormatUint(s.resourceVersion, 10)},
+	}
+	for _, node := range s.nodes {
+		if selector.Matches(objectFields(node)) {
+			list.Items = append(list.Items, *node)
+		}
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Name < list.Items[j].Name
+	})
+	writeObject(w, http.StatusOK, list)
+}
+
+func (s *FakeAPIServer) servePodList(w http.ResponseWriter, r *http.Request, namespace string) {
+	selector, ok := s.listOrWatch(w, r, "pods", namespace)
+	if !ok {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	list := &v1.PodList{
+		TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+		ListMeta: metav1.ListMeta{ResourceVersion: strconv.FormatUint(s.resourceVersion, 10)},
+	}
+	for _, pod := range s.pods {
+		if namespace != "" && pod.Namespace != namespace {
+			continue
+		}
+		if !selector.Matches(objectFields(pod)) {
+			continue
+		}
+		list.Items = append(list.Items, *pod)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Namespace+"/"+list.Items[i].Name < list.Items[j].Namespace+"/"+list.Items[j].Name
+	})
+	writeObject(w, http.StatusOK, list)
+}
+
+// listOrWatch returns the field selector of a list of resource, or serves
+// the request and returns false when it is a watch or invalid.
+func (s *FakeAPIServer) listOrWatch(w http.ResponseWriter, r *http.Request, resource, namespace string) (fields.Selector, bool) {
+	if r.Method != http.MethodGet {
+		writeError(w, apierrors.NewMethodNotSupported(schema.GroupResource{Resource: resource}, r.Method))
+		return nil, false
+	}
+	selector, err := fields.ParseSelector(r.URL.Query().Get("fieldSelector"))
+	if err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return nil, false
+	}
+	if watching, _ := strconv.ParseBool(r.URL.Query().Get("watch")); !watching {
+		return selector, true
+	}
+
+	var since uint64
+	if rv := r.URL.Query().Get("resourceVersion"); rv != "" {
+		if since, err = strconv.ParseUint(rv, 10, 64); err != nil {
+			writeError(w, apierrors.NewBadRequest(fmt.Sprintf("invalid resource version %q", rv)))
+			return nil, false
+		}
+	}
+	s.watch(w, r, &watcher{
+		resource:  resource,
+		namespace: namespace,
+		selector:  selector,
+	}, since)
+	return nil, false
+}
+
+// watch streams the changes the watcher sees made after resource version
+// since, or after the watch started when since is 0, until the client or the
+// server goes away.
+func (s *FakeAPIServer) watch(w http.ResponseWriter, r *http.Request, watcher *watcher, since uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, apierrors.NewInternalError(errors.New("streaming not supported")))
+		return
+	}
+
+	s.Lock()
+	var replay []*watchEvent
+	if since > 0 {
+		for _, change := range s.changes {
+			if change.resourceVersion <= since {
+				continue
+			}
+			if event := watcher.event(change); event != nil {
+				replay = append(replay, event)
+			}
+		}
+	}
+	watcher.events = make(chan *watchEvent, len(replay)+100)
+	for _, event := range replay {
+		watcher.events <- event
+	}
+	s.watchers[watcher] = true
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.watchers, watcher)
+		s.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-watcher.events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// objectFields are the fields of obj the field selectors can match.
+func objectFields(obj object) fields.Set {
+	set := fields.Set{
+		"metadata.name":      obj.GetName(),
+		"metadata.namespace": obj.GetNamespace(),
+	}
+	if pod, ok := obj.(*v1.Pod); ok {
+		set["spec.nodeName"] = pod.Spec.NodeName
+		set["status.phase"] = string(pod.Status.Phase)
+	}
+	return set
+}
+
+func (s *FakeAPIServer) servePod(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	resource := schema.GroupResource{Resource: "pods"}
+	key := namespace + "/" + name
+	pod, ok := s.pods[key]
+	if !ok {
+		writeError(w, apierrors.NewNotFound(resource, name))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		updated := &v1.Pod{}
+		if err := readObject(r, updated); err != nil {
+			writeError(w, err)
+			return
+		}
+		if updated.ResourceVersion != "" && updated.ResourceVersion != pod.ResourceVersion {
+			writeError(w, apierrors.NewConflict(resource, name, errors.New(optimisticLockErrorMsg)))
+			return
+		}
+		pod = updated
+	case http.MethodPatch:
+		patched := &v1.Pod{}
+		if err := applyPatch(r, pod, patched); err != nil {
+			writeError(w, err)
+			return
+		}
+		if patched.ResourceVersion != "" && patched.ResourceVersion != pod.ResourceVersion {
+			writeError(w, apierrors.NewConflict(resource, name, errors.New(optimisticLockErrorMsg)))
+			return
+		}
+		pod = patched
+	case http.MethodDelete:
+		s.nextResourceVersion()
+		s.notify("pods", pod, nil)
+		delete(s.pods, key)
+		writeObject(w, http.StatusOK, &metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusSuccess,
+		})
+		return
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(resource, r.Method))
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		pod.ResourceVersion = s.nextResourceVersion()
+		s.notify("pods", s.pod(key), pod)
+		s.pods[key] = pod
+	}
+	pod.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+	writeObject(w, http.StatusOK, pod)
+}
+
+func (s *FakeAPIServer) serveEvents(w http.ResponseWriter, r *http.Request, namespace string) {
+	if r.Method != http.MethodPost {
+		writeError(w, apierrors.NewMethodNotSupported(schema.GroupResource{Resource: "events"}, r.Method))
+		return
+	}
+	event := &v1.Event{}
+	if err := readObject(r, event); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	event.Namespace = namespace
+	if event.Name == "" {
+		event.Name = fmt.Sprintf("%s.%d", event.InvolvedObject.Name, s.resourceVersion+1)
+	}
+	event.ResourceVersion = s.nextResourceVersion()
+	s.events = append(s.events, event)
+	event.TypeMeta = metav1.TypeMeta{Kind: "Event", APIVersion: "v1"}
+	writeObject(w, http.StatusCreated, event)
+}
+
+// serveEvent serves the updates of the event counts made by the event
+// recorders when an event repeats.
+func (s *FakeAPIServer) serveEvent(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	resource := schema.GroupResource{Resource: "events"}
+	i := 0
+	for ; i < len(s.events); i++ {
+		if s.events[i].Namespace == namespace && s.events[i].Name == name {
+			break
+		}
+	}
+	if i == len(s.events) {
+		writeError(w, apierrors.NewNotFound(resource, name))
+		return
+	}
+
+	event := s.events[i]
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		patched := &v1.Event{}
+		if err := applyPatch(r, event, patched); err != nil {
+			writeError(w, err)
+			return
+		}
+		patched.ResourceVersion = s.nextResourceVersion()
+		s.events[i] = patched
+		event = patched
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(resource, r.Method))
+		return
+	}
+	event = event.DeepCopy()
+	event.TypeMeta = metav1.TypeMeta{Kind: "Event", APIVersion: "v1"}
+	writeObject(w, http.StatusOK, event)
+}
+
+const optimisticLockErrorMsg = "the object has been modified; please apply your changes to the latest version and try again"
+
+func readObject(r *http.Request, obj interface{}) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	return nil
+}
+
+// applyPatch applies the merge or strategic merge patch in the body of r
+// to original and decodes the result into patched.
+func applyPatch(r *http.Request, original, patched interface{}) error {
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	data, err := json.Marshal(original)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+
+	switch contentType := r.Header.Get("Content-Type"); contentType {
+	case string(types.MergePatchType), string(types.StrategicMergePatchType):
+		// Annotations and labels merge the same way with both patch types.
+		data, err = mergePatch(data, patch)
+	default:
+		return apierrors.NewBadRequest(fmt.Sprintf("unsupported patch type %q", contentType))
+	}
+	if err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	if err := json.Unmarshal(data, patched); err != nil {
+		return apierrors.NewBadRequest(err.Error())
+	}
+	return nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to doc.
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	var original, changes interface{}
+	if err := json.Unmarshal(doc, &original); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(original, changes))
+}
+
+func mergeValue(original, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	originalMap, ok := original.(map[string]interface{})
+	if !ok {
+		originalMap = map[string]interface{}{}
+	}
+	for k, v := range patchMap {
+		if v == nil {
+			delete(originalMap, k)
+			continue
+		}
+		originalMap[k] = mergeValue(originalMap[k], v)
+	}
+	return originalMap
+}
+
+func writeObject(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		status = apierrors.NewInternalError(err)
+	}
+	s := status.Status()
+	s.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeObject(w, int(s.Code), &s)
+}
@@ -0,0 +1,140 @@
+// Package harness runs the device plugin against in-process fakes of kubelet,
+// the API server and the GPUs, so the plugin lifecycle can be exercised
+// end to end on machines without a GPU or a cluster.
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hellolijj/k8s-device-plugin/pkg/gpu/nvidia"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// NodeName is the name of the node the plugin believes it runs on.
+	NodeName = "fake-gpu-node"
+	// ResourceName is the resource the plugin registers.
+	ResourceName = "aliyun.com/gpu"
+)
+
+// Harness wires the device plugin to a fake kubelet, API server and GPU backend.
+type Harness struct {
+	// Dir stands in for /var/lib/kubelet/device-plugins.
+	Dir       string
+	Kubelet   *FakeKubelet
+	APIServer *FakeAPIServer
+	Backend   nvidia.Backend
+	Kube      *nvidia.KubeClient
+	// Options are passed to the plugin on Start and may be tuned before.
+	Options *nvidia.Options
+
+	stop chan struct{}
+	done chan error
+}
+
+// New prepares a harness for the GPUs described by fixture. Nothing runs
+// until Start is called.
+func New(fixture *nvidia.FakeFixture) (*Harness, error) {
+	backend, err := nvidia.NewFakeBackend(fixture)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "device-plugins")
+	if err != nil {
+		return nil, err
+	}
+
+	apiServer := NewFakeAPIServer(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: NodeName},
+	})
+	clientset, config, err := apiServer.Clientset()
+	if err != nil {
+		apiServer.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	kube := nvidia.NewKubeClient(clientset, NodeName)
+	kube.Config = config
+
+	options := nvidia.NewOptionsFromEnv()
+	options.DevicePluginPath = dir
+	options.RebootMarks = filepath.Join(dir, "unhealthy-until-reboot.json")
+	options.NodeTypeURL = apiServer.NodeTypeURL()
+
+	return &Harness{
+		Dir:       dir,
+		Kubelet:   NewFakeKubelet(dir),
+		APIServer: apiServer,
+		Backend:   backend,
+		Kube:      kube,
+		Options:   options,
+	}, nil
+}
+
+// Start brings the fake kubelet up and runs the plugin manager, which then
+// registers the plugin with it.
+func (h *Harness) Start() error {
+	if err := h.Kubelet.Start(); err != nil {
+		return err
+	}
+
+	h.stop = make(chan struct{})
+	h.done = make(chan error, 1)
+	manager := nvidia.NewGPUManager(h.Backend, h.Kube, h.Options)
+	go func() {
+		h.done <- manager.Run(h.stop)
+	}()
+
+	return nil
+}
+
+// WaitForPlugin waits for the plugin to register and to send its device list.
+func (h *Harness) WaitForPlugin(timeout time.Duration) (*PluginClient, error) {
+	return h.waitForPlugin(nil, timeout)
+}
+
+// RestartKubelet restarts the fake kubelet and waits for the plugin to
+// register again.
+func (h *Harness) RestartKubelet(timeout time.Duration) (*PluginClient, error) {
+	previous, _ := h.Kubelet.Plugin(ResourceName)
+	if err := h.Kubelet.Restart(); err != nil {
+		return nil, err
+	}
+	return h.waitForPlugin(previous, timeout)
+}
+
+func (h *Harness) waitForPlugin(previous *PluginClient, timeout time.Duration) (*PluginClient, error) {
+	deadline := time.Now().Add(timeout)
+	p, err := h.Kubelet.WaitForPlugin(ResourceName, previous, timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = p.WaitForDevices(time.Until(deadline), func(devs []*pluginapi.Device) bool {
+		return len(devs) > 0
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no device list received from the plugin: %v", err)
+	}
+	return p, nil
+}
+
+// Stop shuts the plugin, the fakes and the temp dir down.
+func (h *Harness) Stop() error {
+	var err error
+	if h.stop != nil {
+		close(h.stop)
+		err = <-h.done
+		h.stop = nil
+	}
+	h.Kubelet.Stop()
+	h.APIServer.Close()
+	os.RemoveAll(h.Dir)
+	return err
+}
@@ -0,0 +1,311 @@
+package harness
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hellolijj/k8s-device-plugin/pkg/gpu/nvidia"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const timeout = 10 * time.Second
+
+// startHarness starts a harness for the fixture, after setup tuned it when
+// not nil, and waits for the plugin.
+func startHarness(t *testing.T, fixture *nvidia.FakeFixture, setup func(*Harness)) (*Harness, *PluginClient) {
+	h, err := New(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(h)
+	}
+	if err := h.Start(); err != nil {
+		h.Stop()
+		t.Fatal(err)
+	}
+	p, err := h.WaitForPlugin(timeout)
+	if err != nil {
+		h.Stop()
+		t.Fatal(err)
+	}
+	return h, p
+}
+
+func fakeGPUs(n int) *nvidia.FakeFixture {
+	fixture := &nvidia.FakeFixture{}
+	for i := 0; i < n; i++ {
+		fixture.GPUs = append(fixture.GPUs, nvidia.FakeGPU{UUID: fmt.Sprintf("GPU-%d", i), Memory: 16384})
+	}
+	return fixture
+}
+
+func TestRegistration(t *testing.T) {
+	h, p := startHarness(t, fakeGPUs(2), nil)
+	defer h.Stop()
+
+	if n := h.Kubelet.Registrations(); n != 1 {
+		t.Errorf("expected 1 registration, got %d", n)
+	}
+	if err := p.WaitForDevices(timeout, Healthy(2)); err != nil {
+		t.Fatalf("expected 2 healthy gpus, got %v: %v", p.Devices(), err)
+	}
+	ids := map[string]bool{}
+	for _, d := range p.Devices() {
+		ids[d.ID] = true
+	}
+	if !ids["GPU-0"] || !ids["GPU-1"] {
+		t.Errorf("expected the gpus to be advertised by uuid, got %v", p.Devices())
+	}
+}
+
+func TestReRegistration(t *testing.T) {
+	h, p := startHarness(t, fakeGPUs(2), nil)
+	defer h.Stop()
+
+	restarted, err := h.RestartKubelet(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted == p {
+		t.Fatalf("expected a new connection after the kubelet restart")
+	}
+	if n := h.Kubelet.Registrations(); n != 2 {
+		t.Errorf("expected 2 registrations, got %d", n)
+	}
+	if err := restarted.WaitForDevices(timeout, Healthy(2)); err != nil {
+		t.Errorf("expected 2 healthy gpus after the restart, got %v: %v", restarted.Devices(), err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	fixture := fakeGPUs(2)
+	fixture.Events = []nvidia.FakeXIDEvent{{After: "200ms", UUID: "GPU-1", Xid: 79}}
+	h, p := startHarness(t, fixture, nil)
+	defer h.Stop()
+
+	if err := p.WaitForDevices(timeout, Healthy(1)); err != nil {
+		t.Fatalf("expected the xid to mark a gpu unhealthy, got %v: %v", p.Devices(), err)
+	}
+	for _, d := range p.Devices() {
+		if healthy := d.Health == pluginapi.Healthy; healthy != (d.ID == "GPU-0") {
+			t.Errorf("unexpected health %s of gpu %s", d.Health, d.ID)
+		}
+	}
+
+	err := wait.PollImmediate(10*time.Millisecond, timeout, func() (bool, error) {
+		for _, e := range h.APIServer.Events() {
+			if e.Reason == "GPUUnhealthy" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Errorf("expected a GPUUnhealthy event: %v", err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, timeout, func() (bool, error) {
+		node, _ := h.APIServer.Node(NodeName)
+		return strings.Contains(node.Annotations[nvidia.EnvHealthHistoryKey], `"1":[{`), nil
+	})
+	if err != nil {
+		t.Errorf("expected the transition of gpu 1 in the health history: %v", err)
+	}
+}
+
+func TestUnhealthyUntilReboot(t *testing.T) {
+	fixture := fakeGPUs(2)
+	fixture.Events = []nvidia.FakeXIDEvent{{After: "200ms", UUID: "GPU-1", Xid: 79}}
+	h, p := startHarness(t, fixture, nil)
+	defer h.Stop()
+
+	if err := p.WaitForDevices(timeout, Healthy(1)); err != nil {
+		t.Fatalf("expected the xid to mark a gpu unhealthy, got %v: %v", p.Devices(), err)
+	}
+
+	// The restarted plugin sees no xid, only the mark kept on the host.
+	fixture.Events = nil
+	p, err := h.RestartKubelet(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range p.Devices() {
+		if healthy := d.Health == pluginapi.Healthy; healthy != (d.ID == "GPU-0") {
+			t.Errorf("unexpected health %s of gpu %s after the restart", d.Health, d.ID)
+		}
+	}
+}
+
+func TestAllocation(t *testing.T) {
+	h, p := startHarness(t, fakeGPUs(2), nil)
+	defer h.Stop()
+
+	addAssumedPod(h, "trainer", "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := p.Allocate(ctx, []string{"GPU-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ContainerResponses) != 1 {
+		t.Fatalf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	if visible := resp.ContainerResponses[0].Envs[nvidia.EnvNVGPU]; visible != "GPU-1" {
+		t.Errorf("expected the assumed gpu GPU-1 to be visible, got %q", visible)
+	}
+
+	pod, ok := h.APIServer.Pod(metav1.NamespaceDefault, "trainer")
+	if !ok {
+		t.Fatal("pod trainer is gone")
+	}
+	if assigned := pod.Annotations[nvidia.EnvAssignedFlag]; assigned != "true" {
+		t.Errorf("expected the pod to be marked assigned, got %q", assigned)
+	}
+}
+
+func TestPreferredAllocation(t *testing.T) {
+	h, p := startHarness(t, fakeGPUs(4), nil)
+	defer h.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	available := []string{"GPU-0", "GPU-1", "GPU-2", "GPU-3"}
+	resp, err := p.GetPreferredAllocation(ctx, available, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := resp.ContainerResponses[0].DeviceIDs; len(ids) != 1 {
+		t.Errorf("expected 1 preferred gpu, got %v", ids)
+	}
+
+	addAssumedPod(h, "trainer", "2")
+	var ids []string
+	err = wait.PollImmediate(10*time.Millisecond, timeout, func() (bool, error) {
+		resp, err := p.GetPreferredAllocation(ctx, available, nil, 1)
+		if err != nil {
+			return false, err
+		}
+		ids = resp.ContainerResponses[0].DeviceIDs
+		return len(ids) == 1 && ids[0] == "GPU-2", nil
+	})
+	if err != nil {
+		t.Errorf("expected the assumed gpu GPU-2 preferred, got %v: %v", ids, err)
+	}
+}
+
+func TestAllocationFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		gpus    string
+		devices []string
+	}{
+		{"invalid gpu", "5", []string{"GPU-0"}},
+		{"unknown device", "1", []string{"GPU-9"}},
+	}
+	for _, test := range tests {
+		for _, policy := range []string{nvidia.RestrictedFailurePolicy, nvidia.FailClosedPolicy} {
+			func() {
+				h, p := startHarness(t, fakeGPUs(2), func(h *Harness) {
+					h.Options.FailurePolicy = policy
+				})
+				defer h.Stop()
+
+				addAssumedPod(h, "trainer", test.gpus)
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				resp, err := p.Allocate(ctx, test.devices)
+				if policy == nvidia.FailClosedPolicy {
+					if status.Code(err) != codes.FailedPrecondition {
+						t.Errorf("%s, %s: expected FailedPrecondition, got %v", test.name, policy, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s, %s: %v", test.name, policy, err)
+				}
+				for _, r := range resp.ContainerResponses {
+					if visible := r.Envs[nvidia.EnvNVGPU]; visible != "none" {
+						t.Errorf("%s, %s: expected no gpu visible, got %q", test.name, policy, visible)
+					}
+				}
+			}()
+		}
+	}
+}
+
+func TestPreStart(t *testing.T) {
+	h, p := startHarness(t, fakeGPUs(2), func(h *Harness) {
+		h.Options.PreStartRequired = true
+		h.APIServer.AddNode(maintenanceNode("1"))
+	})
+	defer h.Stop()
+
+	addAssumedPod(h, "trainer", "1")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := p.Allocate(ctx, []string{"GPU-0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// kubelet picked GPU-0, the container got the assumed GPU-1.
+	_, err := p.PreStartContainer(ctx, []string{"GPU-0"})
+	if err == nil || !strings.Contains(err.Error(), "gpu 1 is under maintenance") {
+		t.Fatalf("expected gpu 1 to be under maintenance, got %v", err)
+	}
+
+	h.APIServer.AddNode(maintenanceNode(""))
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err = p.PreStartContainer(ctx, []string{"GPU-0"}); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gpu 1 still not ready after the maintenance ended: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// addAssumedPod adds a pending pod on the node with one gpu container the
+// scheduler extender assumed the given gpus for.
+func addAssumedPod(h *Harness, name, gpus string) {
+	h.APIServer.AddPod(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				nvidia.EnvResourceIndex:      gpus,
+				nvidia.EnvAssignedFlag:       "false",
+				nvidia.EnvResourceAssumeTime: fmt.Sprintf("%d", time.Now().UnixNano()),
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: NodeName,
+			Containers: []v1.Container{{
+				Name: "main",
+				Resources: v1.ResourceRequirements{
+					Limits: v1.ResourceList{ResourceName: resource.MustParse("1")},
+				},
+			}},
+		},
+		Status: v1.PodStatus{Phase: v1.PodPending},
+	})
+}
+
+// maintenanceNode is the node with the given gpus under maintenance.
+func maintenanceNode(gpus string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: NodeName}}
+	if gpus != "" {
+		node.Annotations = map[string]string{nvidia.EnvMaintenanceKey: gpus}
+	}
+	return node
+}
@@ -0,0 +1,304 @@
+package harness
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/util/wait"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const dialTimeout = 5 * time.Second
+
+// FakeKubelet serves the kubelet Registration API on <dir>/kubelet.sock and
+// talks back to the plugins registering on it the way kubelet does: it
+// fetches their options, keeps a ListAndWatch stream open and lets callers
+// issue Allocate and PreStartContainer calls over gRPC.
+type FakeKubelet struct {
+	dir    string
+	server *grpc.Server
+
+	sync.Mutex
+	plugins       map[string]*PluginClient
+	registrations int
+}
+
+// NewFakeKubelet returns a kubelet listening in dir once started.
+func NewFakeKubelet(dir string) *FakeKubelet {
+	return &FakeKubelet{
+		dir:     dir,
+		plugins: map[string]*PluginClient{},
+	}
+}
+
+// Socket is the path of the registration socket.
+func (k *FakeKubelet) Socket() string {
+	return filepath.Join(k.dir, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// Start creates kubelet.sock and serves the Registration API on it.
+func (k *FakeKubelet) Start() error {
+	if err := os.Remove(k.Socket()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sock, err := net.Listen("unix", k.Socket())
+	if err != nil {
+		return err
+	}
+
+	k.Lock()
+	k.server = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	server := k.server
+	k.Unlock()
+
+	go server.Serve(sock)
+	return nil
+}
+
+// Stop shuts the Registration API down, drops every plugin connection and
+// removes kubelet.sock.
+func (k *FakeKubelet) Stop() {
+	k.Lock()
+	server := k.server
+	plugins := k.plugins
+	k.server = nil
+	k.plugins = map[string]*PluginClient{}
+	k.Unlock()
+
+	if server != nil {
+		server.Stop()
+	}
+	for _, p := range plugins {
+		p.Close()
+	}
+	os.Remove(k.Socket())
+}
+
+// Restart simulates a kubelet restart. Plugins are forgotten and kubelet.sock
+// is recreated, which is what device plugins watch for to register again.
+func (k *FakeKubelet) Restart() error {
+	k.Stop()
+	return k.Start()
+}
+
+// Register implements the kubelet Registration service.
+func (k *FakeKubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if r.Version != pluginapi.Version {
+		return nil, fmt.Errorf("unsupported device plugin api version %s", r.Version)
+	}
+
+	k.Lock()
+	k.registrations++
+	k.Unlock()
+
+	// kubelet connects to the plugin once the registration call returned.
+	go func() {
+		p, err := newPluginClient(filepath.Join(k.dir, r.Endpoint), r.ResourceName)
+		if err != nil {
+			log.Warningf("Failed to connect to device plugin %s: %v", r.ResourceName, err)
+			return
+		}
+
+		k.Lock()
+		old := k.plugins[r.ResourceName]
+		k.plugins[r.ResourceName] = p
+		k.Unlock()
+
+		if old != nil {
+			old.Close()
+		}
+	}()
+
+	return &pluginapi.Empty{}, nil
+}
+
+// Registrations is the number of successful Register calls served so far.
+func (k *FakeKubelet) Registrations() int {
+	k.Lock()
+	defer k.Unlock()
+
+	return k.registrations
+}
+
+// Plugin returns the connection to the plugin registered for resourceName.
+func (k *FakeKubelet) Plugin(resourceName string) (*PluginClient, bool) {
+	k.Lock()
+	defer k.Unlock()
+
+	p, ok := k.plugins[resourceName]
+	return p, ok
+}
+
+// WaitForPlugin waits until a plugin other than previous is connected for
+// resourceName. Pass a nil previous for the first registration.
+func (k *FakeKubelet) WaitForPlugin(resourceName string, previous *PluginClient, timeout time.Duration) (*PluginClient, error) {
+	var p *PluginClient
+	err := wait.PollImmediate(10*time.Millisecond, timeout, func() (bool, error) {
+		var ok bool
+		p, ok = k.Plugin(resourceName)
+		return ok && p != previous, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no device plugin registered for %s: %v", resourceName, err)
+	}
+	return p, nil
+}
+
+// PluginClient is kubelet's side of the connection to a device plugin.
+type PluginClient struct {
+	ResourceName string
+	Options      *pluginapi.DevicePluginOptions
+
+	conn   *grpc.ClientConn
+	client pluginapi.DevicePluginClient
+	cancel context.CancelFunc
+
+	sync.Mutex
+	devices []*pluginapi.Device
+	updates int
+	err     error
+}
+
+func newPluginClient(endpoint, resourceName string) (*PluginClient, error) {
+	conn, err := grpc.Dial(endpoint, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithTimeout(dialTimeout),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := pluginapi.NewDevicePluginClient(conn)
+	options, err := client.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+
+	p := &PluginClient{
+		ResourceName: resourceName,
+		Options:      options,
+		conn:         conn,
+		client:       client,
+		cancel:       cancel,
+	}
+	go p.watch(stream)
+
+	return p, nil
+}
+
+func (p *PluginClient) watch(stream pluginapi.DevicePlugin_ListAndWatchClient) {
+	for {
+		resp, err := stream.Recv()
+
+		p.Lock()
+		if err != nil {
+			p.err = err
+			p.Unlock()
+			return
+		}
+		p.devices = resp.Devices
+		p.updates++
+		p.Unlock()
+	}
+}
+
+// Devices returns the device list of the last ListAndWatch update.
+func (p *PluginClient) Devices() []*pluginapi.Device {
+	p.Lock()
+	defer p.Unlock()
+
+	devs := make([]*pluginapi.Device, 0, len(p.devices))
+	for _, d := range p.devices {
+		dev := *d
+		devs = append(devs, &dev)
+	}
+	return devs
+}
+
+// Updates is the number of ListAndWatch responses received so far.
+func (p *PluginClient) Updates() int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.updates
+}
+
+// StreamErr returns the error which ended the ListAndWatch stream, if any.
+func (p *PluginClient) StreamErr() error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.err
+}
+
+// WaitForDevices waits until the advertised devices satisfy cond.
+func (p *PluginClient) WaitForDevices(timeout time.Duration, cond func([]*pluginapi.Device) bool) error {
+	return wait.PollImmediate(10*time.Millisecond, timeout, func() (bool, error) {
+		return cond(p.Devices()), nil
+	})
+}
+
+// Allocate sends one AllocateRequest holding a container request per ids slice.
+func (p *PluginClient) Allocate(ctx context.Context, containers ...[]string) (*pluginapi.AllocateResponse, error) {
+	req := &pluginapi.AllocateRequest{}
+	for _, ids := range containers {
+		req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: ids})
+	}
+	return p.client.Allocate(ctx, req)
+}
+
+// GetPreferredAllocation asks the plugin which size devices out of available,
+// holding mustInclude, it prefers for one container.
+func (p *PluginClient) GetPreferredAllocation(ctx context.Context, available, mustInclude []string, size int) (*pluginapi.PreferredAllocationResponse, error) {
+	return p.client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs:   available,
+			MustIncludeDeviceIDs: mustInclude,
+			AllocationSize:       int32(size),
+		}},
+	})
+}
+
+// PreStartContainer calls the plugin like kubelet does before starting a
+// container, when the plugin asked for it in its options.
+func (p *PluginClient) PreStartContainer(ctx context.Context, ids []string) (*pluginapi.PreStartContainerResponse, error) {
+	return p.client.PreStartContainer(ctx, &pluginapi.PreStartContainerRequest{DevicesIDs: ids})
+}
+
+// Close stops watching the plugin and closes the connection.
+func (p *PluginClient) Close() {
+	p.cancel()
+	p.conn.Close()
+}
+
+// Healthy returns a WaitForDevices condition matching count healthy devices.
+func Healthy(count int) func([]*pluginapi.Device) bool {
+	return func(devs []*pluginapi.Device) bool {
+		n := 0
+		for _, d := range devs {
+			if d.Health == pluginapi.Healthy {
+				n++
+			}
+		}
+		return n == count
+	}
+}